@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/anuraggr/adam/engine"
+	"github.com/anuraggr/adam/util"
+)
+
+// batchEntry is one download from an input file. The layout follows
+// aria2: a URL at the start of a line, followed by indented key=value
+// options that apply to it.
+type batchEntry struct {
+	URL      string
+	Out      string
+	Dir      string
+	Checksum string
+	Headers  []string
+	// Group is a unique ID for the entries of one url pattern, the
+	// pattern itself is GroupName
+	Group     string
+	GroupName string
+}
+
+type batchResult struct {
+	entry    batchEntry
+	filename string
+	// id is set once the session exists
+	id  string
+	err error
+}
+
+func parseInputFile(r io.Reader) ([]batchEntry, error) {
+	var entries []batchEntry
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+
+	for scanner.Scan() {
+		lineNo++
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// indented lines are options for the previous url
+		if raw[0] == ' ' || raw[0] == '\t' {
+			if len(entries) == 0 {
+				return nil, fmt.Errorf("line %d: option without a url", lineNo)
+			}
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				return nil, fmt.Errorf("line %d: expected key=value, got %q", lineNo, line)
+			}
+			entry := &entries[len(entries)-1]
+			value = strings.TrimSpace(value)
+			switch strings.TrimSpace(key) {
+			case "out", "o":
+				entry.Out = value
+			case "dir", "d":
+				entry.Dir = value
+			case "checksum":
+				if err := engine.ValidateChecksum(value); err != nil {
+					return nil, fmt.Errorf("line %d: %v", lineNo, err)
+				}
+				entry.Checksum = value
+			case "header":
+				entry.Headers = append(entry.Headers, value)
+			default:
+				return nil, fmt.Errorf("line %d: unknown option %q", lineNo, key)
+			}
+			continue
+		}
+
+		// aria2 allows tab separated mirrors, we only use the first
+		url, _, _ := strings.Cut(line, "\t")
+		entries = append(entries, batchEntry{URL: strings.TrimSpace(url)})
+	}
+
+	return entries, scanner.Err()
+}
+
+// batchDefaults are command line options that apply to every entry
+// of a batch unless the entry sets its own.
+type batchDefaults struct {
+	Dir     string
+	Headers []string
+}
+
+func (b batchDefaults) apply(entry *batchEntry) {
+	if entry.Dir == "" {
+		entry.Dir = b.Dir
+	}
+	entry.Headers = append(append([]string(nil), b.Headers...), entry.Headers...)
+}
+
+func runBatchCommand(input string, defaults batchDefaults, parallel int, df *downloadFlags) int {
+	var r io.Reader = os.Stdin
+	if input != "-" {
+		file, err := os.Open(input)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return exitUsage
+		}
+		defer file.Close()
+		r = file
+	}
+
+	entries, err := parseInputFile(r)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading input file:", err)
+		return exitUsage
+	}
+	if len(entries) == 0 {
+		fmt.Fprintln(os.Stderr, "No urls found in input.")
+		return exitOK
+	}
+
+	return runEntries(entries, defaults, parallel, df)
+}
+
+// runEntries applies the command line defaults and downloads entries
+// as a batch.
+func runEntries(entries []batchEntry, defaults batchDefaults, parallel int, df *downloadFlags) int {
+	settings, err := df.settings()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitCode(err)
+	}
+
+	mode, rep, err := df.output()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitCode(err)
+	}
+
+	for i := range entries {
+		defaults.apply(&entries[i])
+	}
+
+	b := &batch{settings: settings, parallel: parallel, out: os.Stdout, errOut: os.Stderr}
+	if df.quiet {
+		b.out = io.Discard
+	}
+	if mode == "json" {
+		// progress notes would get in between the events
+		b.out = io.Discard
+		b.json = rep.(*jsonReporter)
+	}
+	return b.run(entries)
+}
+
+// batch downloads several entries with the same settings.
+type batch struct {
+	settings engine.Settings
+	parallel int
+	// out gets progress notes and the summary, errOut the failures,
+	// which stay visible with stdout redirected or quiet
+	out    io.Writer
+	errOut io.Writer
+	// json gets the events of every entry with --progress=json
+	json *jsonReporter
+}
+
+// run downloads all entries, at most parallel at a time, prints a
+// summary and returns the exit code. Every entry gets its own session
+// so a failed or interrupted one can be picked up later with
+// 'adam resume'.
+func (b *batch) run(entries []batchEntry) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	results := make([]batchResult, len(entries))
+	sem := make(chan struct{}, b.parallel)
+	var wg sync.WaitGroup
+
+	for i, entry := range entries {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, entry batchEntry) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			prefix := fmt.Sprintf("[%d/%d]", i+1, len(entries))
+			results[i] = b.download(ctx, entry, prefix)
+		}(i, entry)
+	}
+
+	wg.Wait()
+	if b.printSummary(results) == 0 {
+		return exitOK
+	}
+	if ctx.Err() != nil {
+		return exitInterrupted
+	}
+	return exitFailure
+}
+
+func (b *batch) download(ctx context.Context, entry batchEntry, prefix string) batchResult {
+	result := batchResult{entry: entry}
+
+	name := entry.Out
+	if name == "" {
+		name = filepath.Base(entry.URL)
+	}
+	if entry.Dir != "" {
+		if err := os.MkdirAll(entry.Dir, 0755); err != nil {
+			result.err = err
+			return result
+		}
+		name = filepath.Join(entry.Dir, name)
+	}
+	result.filename = name
+
+	fmt.Fprintf(b.out, "%s Starting %s\n", prefix, name)
+
+	opts := engine.DefaultOptions()
+	opts.Settings = b.settings
+	opts.Headers = entry.Headers
+	opts.Checksum = entry.Checksum
+	opts.Group = entry.Group
+	opts.GroupName = entry.GroupName
+	var rep *jsonReporter
+	if b.json != nil {
+		rep = b.json.entry(name)
+	}
+	opts.OnEvent = func(e engine.Event) {
+		if rep != nil {
+			rep.Handle(e)
+		}
+		if probe, ok := e.(engine.ProbeEvent); ok && !probe.RangeSupport {
+			fmt.Fprintf(b.out, "%s Server does not support range requests, using a single worker\n", prefix)
+		}
+	}
+
+	d, err := engine.New(ctx, entry.URL, name, opts)
+	if err != nil {
+		result.err = err
+		fmt.Fprintf(b.errOut, "%s Failed %s: %v\n", prefix, name, err)
+		if rep != nil {
+			rep.Finish(err, exitCode(err))
+		}
+		return result
+	}
+	defer d.Close()
+
+	state := d.State()
+	result.id = state.ID
+	result.err = d.Run(ctx)
+	if rep != nil {
+		code, err := runResult(ctx, result.err)
+		rep.Finish(err, code)
+	}
+
+	if result.err != nil {
+		fmt.Fprintf(b.errOut, "%s Failed %s: %v\n", prefix, name, result.err)
+	} else {
+		fmt.Fprintf(b.out, "%s Done %s (%s)\n", prefix, name, util.FormatBytes(state.TotalSize))
+	}
+	return result
+}
+
+// runGlobCommand downloads every url matched by a glob pattern as one
+// group, which 'adam ls' shows as a single row.
+func runGlobCommand(pattern string, matches []globMatch, template string, defaults batchDefaults, parallel int, df *downloadFlags) int {
+	// the same pattern may be downloaded again, to another dir
+	group, name := engine.NewSessionID(), filepath.Base(pattern)
+
+	entries := make([]batchEntry, len(matches))
+	seen := make(map[string]bool)
+	for i, m := range matches {
+		out := filepath.Base(m.URL)
+		if template != "" {
+			var err error
+			out, err = applyTemplate(template, m.Matched)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				return exitUsage
+			}
+		}
+		if seen[out] {
+			fmt.Fprintf(os.Stderr, "Error: several urls would be saved as '%s', use -o with #1, #2 ... to name them\n", out)
+			return exitUsage
+		}
+		seen[out] = true
+		entries[i] = batchEntry{URL: m.URL, Out: out, Group: group, GroupName: name}
+	}
+
+	if !df.quiet && df.progress != "json" {
+		fmt.Printf("Downloading %d files as group '%s'\n", len(entries), name)
+	}
+	return runEntries(entries, defaults, parallel, df)
+}
+
+// printSummary reports every entry and returns the failure count.
+func (b *batch) printSummary(results []batchResult) int {
+	failed := 0
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+		}
+	}
+
+	fmt.Fprintln(b.out)
+	fmt.Fprintf(b.out, "Batch finished: %d succeeded, %d failed\n", len(results)-failed, failed)
+	if failed == 0 {
+		return 0
+	}
+
+	fmt.Fprintln(b.errOut, "Failed downloads:")
+	for _, r := range results {
+		if r.err == nil {
+			continue
+		}
+		name := r.filename
+		if name == "" {
+			name = r.entry.URL
+		}
+		if r.id != "" {
+			name += " [" + r.id + "]"
+		}
+		fmt.Fprintf(b.errOut, "  %s: %v\n", name, r.err)
+	}
+	fmt.Fprintln(b.errOut, "Resume any of them with: adam resume <id>")
+	return failed
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseInputFile(t *testing.T) {
+	input := `# mirrors of the same release
+http://a.example/file.iso	http://b.example/file.iso
+  out=release.iso
+	dir = isos
+  checksum=sha-256=` + strings.Repeat("ab", 32) + `
+
+http://c.example/notes.txt
+  header=Authorization: Bearer x=y
+  # a comment between options
+  header=Accept: text/plain
+`
+	entries, err := parseInputFile(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2: %+v", len(entries), entries)
+	}
+
+	iso := entries[0]
+	if iso.URL != "http://a.example/file.iso" {
+		t.Errorf("url %q, want the first mirror", iso.URL)
+	}
+	if iso.Out != "release.iso" || iso.Dir != "isos" {
+		t.Errorf("out %q, dir %q", iso.Out, iso.Dir)
+	}
+	if iso.Checksum != "sha-256="+strings.Repeat("ab", 32) {
+		t.Errorf("checksum %q, want the value after the first '='", iso.Checksum)
+	}
+
+	notes := entries[1]
+	if fmt.Sprint(notes.Headers) != "[Authorization: Bearer x=y Accept: text/plain]" {
+		t.Errorf("headers %q", notes.Headers)
+	}
+}
+
+func TestParseInputFileErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{input: "  out=x.iso\nhttp://a.example/x.iso\n", err: "line 1: option without a url"},
+		{input: "http://a.example/x.iso\n  out\n", err: "line 2: expected key=value"},
+		{input: "http://a.example/x.iso\n  speed=1M\n", err: `line 2: unknown option "speed"`},
+		{input: "http://a.example/x.iso\n  checksum=md4=00\n", err: "line 2:"},
+	}
+	for _, tt := range tests {
+		_, err := parseInputFile(strings.NewReader(tt.input))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("parseInputFile(%q) = %v, want %q", tt.input, err, tt.err)
+		}
+	}
+}
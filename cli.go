@@ -0,0 +1,662 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/anuraggr/adam/engine"
+	"github.com/anuraggr/adam/util"
+
+	"github.com/mattn/go-isatty"
+	"github.com/spf13/pflag"
+)
+
+// command is one adam subcommand. setup registers the command's flags
+// and returns the function that runs it with the positional arguments.
+// It gets the command itself so the commands can refer to their own
+// usage without an initialization cycle.
+type command struct {
+	name    string
+	aliases []string
+	usage   string
+	summary string
+	setup   func(c *command, fs *pflag.FlagSet) func(args []string) int
+}
+
+var commands []*command
+
+func init() {
+	// assigned here because help refers back to the table
+	commands = []*command{
+		getCommand,
+		resumeCommand,
+		updateCommand,
+		listCommand,
+		infoCommand,
+		historyCommand,
+		rmCommand,
+		cleanCommand,
+		gcCommand,
+		helpCommand,
+	}
+}
+
+// usageError marks errors caused by the command line rather than the
+// download, they exit with exitUsage.
+type usageError struct{ error }
+
+func usageErrorf(format string, args ...any) error {
+	return usageError{fmt.Errorf(format, args...)}
+}
+
+// exitCode maps an error from setting up a download to an exit code.
+func exitCode(err error) int {
+	var usage usageError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &usage):
+		return exitUsage
+	case errors.Is(err, engine.ErrLinkExpired):
+		return exitLinkExpired
+	}
+	return exitFailure
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+		for _, alias := range c.aliases {
+			if alias == name {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// run dispatches the command line and returns the exit code. The
+// command is the first argument that is not a flag, flags may come
+// before and after it. Without one it is 'get', so 'adam <url>' keeps
+// working.
+func run(args []string) int {
+	if len(args) == 0 {
+		if stdoutIsTerminal() && isatty.IsTerminal(os.Stdin.Fd()) {
+			return runManager()
+		}
+		printHelp(os.Stderr)
+		return exitUsage
+	}
+
+	cmd := getCommand
+	if i := firstArg(args); i >= 0 {
+		if c := findCommand(args[i]); c != nil {
+			cmd = c
+			args = append(args[:i:i], args[i+1:]...)
+		}
+	}
+	return cmd.run(args)
+}
+
+// firstArg returns the index of the first argument that is neither a
+// flag nor the value of one, -1 if there is none. Flags are looked up
+// in every command, the one found decides which of them it was.
+func firstArg(args []string) int {
+	fs := pflag.NewFlagSet("all", pflag.ContinueOnError)
+	for _, c := range commands {
+		cfs := pflag.NewFlagSet(c.name, pflag.ContinueOnError)
+		c.setup(c, cfs)
+		cfs.VisitAll(func(f *pflag.Flag) {
+			if fs.Lookup(f.Name) != nil {
+				return
+			}
+			if f.Shorthand != "" && fs.ShorthandLookup(f.Shorthand) != nil {
+				// another command's -x, the long name still counts
+				g := *f
+				g.Shorthand = ""
+				f = &g
+			}
+			fs.AddFlag(f)
+		})
+	}
+	takesValue := func(f *pflag.Flag) bool { return f != nil && f.NoOptDefVal == "" }
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			if i+1 < len(args) {
+				return i + 1
+			}
+			return -1
+		case strings.HasPrefix(arg, "--"):
+			if !strings.Contains(arg, "=") && takesValue(fs.Lookup(arg[2:])) {
+				i++
+			}
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			// in a group like -qn the first flag that takes a value ends
+			// it, the value is the rest as in -n4 or else the next arg
+			for j := 1; j < len(arg); j++ {
+				if takesValue(fs.ShorthandLookup(arg[j : j+1])) {
+					if j == len(arg)-1 {
+						i++
+					}
+					break
+				}
+			}
+		default:
+			return i
+		}
+	}
+	return -1
+}
+
+// isHTTPURL reports whether arg is something get can download.
+func isHTTPURL(arg string) bool {
+	lower := strings.ToLower(arg)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+func (c *command) run(args []string) int {
+	fs := pflag.NewFlagSet(c.name, pflag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.SortFlags = false
+	runFunc := c.setup(c, fs)
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			c.printHelp(os.Stdout, fs)
+			return exitOK
+		}
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Run 'adam help %s' for usage.\n", c.name)
+		return exitUsage
+	}
+	return runFunc(fs.Args())
+}
+
+func (c *command) printHelp(w io.Writer, fs *pflag.FlagSet) {
+	fmt.Fprintf(w, "Usage: adam %s\n\n%s\n", c.usage, c.summary)
+	if len(c.aliases) > 0 {
+		fmt.Fprintf(w, "\nAliases: %s\n", strings.Join(c.aliases, ", "))
+	}
+	if fs.HasFlags() {
+		fmt.Fprintf(w, "\nOptions:\n%s", fs.FlagUsages())
+	}
+}
+
+// argsError reports a bad command line along with the usage line.
+func (c *command) argsError(msg string) int {
+	fmt.Fprintf(os.Stderr, "Error: %s\n", msg)
+	fmt.Fprintf(os.Stderr, "Usage: adam %s\n", c.usage)
+	return exitUsage
+}
+
+// downloadFlags are shared by every command that downloads. Settings
+// flags only override the config file or saved session when given.
+type downloadFlags struct {
+	fs *pflag.FlagSet
+
+	workers    string
+	maxWorkers int
+	maxConn    int
+	http1      bool
+	http3      bool
+	resolve    []string
+	ipv4       bool
+	ipv6       bool
+	dnsServer  string
+	interfaces []string
+	bindAddrs  []string
+	retries    int
+	limitRate  string
+	blockSize  string
+	profile    string
+	quiet      bool
+	noTUI      bool
+	progress   string
+	progressFD int
+}
+
+func addDownloadFlags(fs *pflag.FlagSet) *downloadFlags {
+	f := &downloadFlags{fs: fs}
+	fs.StringVarP(&f.workers, "workers", "n", "", "number of parallel connections, or auto")
+	fs.IntVar(&f.maxWorkers, "max-workers", 0, "most connections --workers auto may open")
+	fs.IntVar(&f.maxConn, "max-conn-per-host", 0, "most connections to the server, instead of what adam learned")
+	fs.BoolVar(&f.http1, "http1", false, "use HTTP/1.1, one connection per worker, even if the server speaks HTTP/2")
+	fs.BoolVar(&f.http3, "http3", false, "use HTTP/3 (QUIC) for https urls, falling back to TCP if it fails")
+	fs.StringArrayVar(&f.resolve, "resolve", nil, "use addr for host:port, as host:port:addr[,addr...]; may be repeated")
+	fs.BoolVarP(&f.ipv4, "ipv4", "4", false, "connect over IPv4 only")
+	fs.BoolVarP(&f.ipv6, "ipv6", "6", false, "connect over IPv6 only")
+	fs.StringVar(&f.dnsServer, "dns-server", "", "look hosts up on this DNS server or DNS-over-HTTPS url")
+	fs.StringSliceVar(&f.interfaces, "interface", nil, "connect through these interfaces, e.g. eth0,eth1, spreading the workers over them")
+	fs.StringSliceVar(&f.bindAddrs, "bind-address", nil, "connect from these local addresses, spreading the workers over them")
+	fs.IntVar(&f.retries, "retries", 0, "attempts per part before giving up")
+	fs.StringVar(&f.limitRate, "limit-rate", "", "cap the download speed, e.g. 500KB or 2MB (per second)")
+	fs.StringVar(&f.blockSize, "block-size", "", "align part boundaries to this size, e.g. the server's block size")
+	fs.StringVar(&f.profile, "profile", "", "use a [profiles.<name>] table from config.toml")
+	fs.BoolVarP(&f.quiet, "quiet", "q", false, "print nothing but errors")
+	fs.BoolVar(&f.noTUI, "no-tui", false, "print plain progress lines instead of the TUI")
+	fs.StringVar(&f.progress, "progress", "", "progress output: tui, plain or json")
+	fs.IntVar(&f.progressFD, "progress-fd", 0, "write json events to this file descriptor")
+	return f
+}
+
+// apply puts the flags that were given on top of s.
+func (f *downloadFlags) apply(s *engine.Settings) error {
+	if f.fs.Changed("workers") {
+		auto, n, err := parseWorkers(f.workers)
+		if err != nil {
+			return usageError{err}
+		}
+		s.AutoWorkers = auto
+		if !auto {
+			s.Workers = n
+		}
+	}
+	if f.fs.Changed("max-workers") {
+		s.WorkerLimit = f.maxWorkers
+	}
+	if f.fs.Changed("max-conn-per-host") {
+		s.MaxConnPerHost = f.maxConn
+	}
+	if f.fs.Changed("http1") {
+		s.HTTP1 = f.http1
+	}
+	if f.fs.Changed("http3") {
+		s.HTTP3 = f.http3
+	}
+	if f.fs.Changed("resolve") {
+		s.Resolve = f.resolve
+	}
+	if f.ipv4 && f.ipv6 {
+		return usageErrorf("--ipv4 and --ipv6 can't be used together")
+	}
+	if f.ipv4 {
+		s.IPVersion = 4
+	}
+	if f.ipv6 {
+		s.IPVersion = 6
+	}
+	if f.fs.Changed("dns-server") {
+		s.DNSServer = f.dnsServer
+	}
+	if f.fs.Changed("interface") {
+		s.Interfaces = f.interfaces
+	}
+	if f.fs.Changed("bind-address") {
+		s.BindAddresses = f.bindAddrs
+	}
+	if f.fs.Changed("retries") {
+		s.MaxRetries = f.retries
+	}
+	if f.fs.Changed("limit-rate") {
+		rate, err := util.ParseBytes(f.limitRate)
+		if err != nil {
+			return usageErrorf("invalid rate '%s'", f.limitRate)
+		}
+		s.RateLimit = rate
+	}
+	if f.fs.Changed("block-size") {
+		size, err := util.ParseBytes(f.blockSize)
+		if err != nil {
+			return usageErrorf("invalid block size '%s'", f.blockSize)
+		}
+		s.BlockSize = size
+	}
+	if err := s.Validate(); err != nil {
+		return usageError{err}
+	}
+	return nil
+}
+
+// parseWorkers reads a worker count, a number or "auto".
+func parseWorkers(v string) (auto bool, n int, err error) {
+	if strings.EqualFold(v, "auto") {
+		return true, 0, nil
+	}
+	n, err = strconv.Atoi(v)
+	if err != nil {
+		return false, 0, fmt.Errorf("invalid worker count '%s', want a number or auto", v)
+	}
+	return false, n, nil
+}
+
+// settings resolves the settings for a new download: defaults, then
+// config file and --profile, then flags.
+func (f *downloadFlags) settings() (engine.Settings, error) {
+	settings, err := loadSettings(f.profile)
+	if err != nil {
+		return settings, usageError{err}
+	}
+	return settings, f.apply(&settings)
+}
+
+// output picks how progress is shown: "tui", "plain" or "json". The
+// TUI is used unless --no-tui or --quiet is given or stdout is not a
+// terminal.
+func (f *downloadFlags) output() (string, reporter, error) {
+	mode := f.progress
+	if mode == "" {
+		mode = "tui"
+		if f.noTUI || f.quiet || !stdoutIsTerminal() {
+			mode = "plain"
+		}
+	}
+
+	switch mode {
+	case "tui", "plain":
+		if f.quiet {
+			// errors go to stderr, so discarding the rest leaves them
+			return "plain", newPlainReporter(io.Discard), nil
+		}
+		return mode, newPlainReporter(os.Stdout), nil
+	case "json":
+		var out io.Writer = os.Stdout
+		if f.fs.Changed("progress-fd") {
+			if f.progressFD < 0 {
+				return "", nil, usageErrorf("invalid file descriptor %d", f.progressFD)
+			}
+			out = os.NewFile(uintptr(f.progressFD), "progress")
+		}
+		return mode, newJSONReporter(out), nil
+	}
+	return "", nil, usageErrorf("unknown progress mode '%s', expected tui, plain or json", mode)
+}
+
+var getCommand = &command{
+	name:    "get",
+	usage:   "[get] [options] <url>...",
+	summary: "Download one or more urls. A url with [01-20] or {a,b} patterns downloads every match.",
+	setup: func(c *command, fs *pflag.FlagSet) func([]string) int {
+		var (
+			output    string
+			dir       string
+			headers   []string
+			checksum  string
+			parallel  int
+			globOff   bool
+			inputFile string
+		)
+		fs.StringVarP(&output, "output", "o", "", "save as this name, #1, #2 ... insert pattern matches")
+		fs.StringVar(&dir, "dir", "", "directory to save files in")
+		fs.StringArrayVarP(&headers, "header", "H", nil, "extra request header 'Name: value', repeatable")
+		fs.StringVar(&checksum, "checksum", "", "verify the file, e.g. sha-256=<hex>")
+		fs.IntVarP(&parallel, "parallel", "j", 1, "files to download at a time")
+		fs.BoolVarP(&globOff, "globoff", "g", false, "treat [] and {} in urls literally")
+		fs.StringVarP(&inputFile, "input-file", "i", "", "download every entry of a file, '-' for stdin")
+		df := addDownloadFlags(fs)
+
+		return func(args []string) int {
+			if parallel < 1 {
+				return c.argsError(fmt.Sprintf("invalid parallel count %d", parallel))
+			}
+			if checksum != "" {
+				if err := engine.ValidateChecksum(checksum); err != nil {
+					return c.argsError(err.Error())
+				}
+			}
+
+			if inputFile != "" {
+				if len(args) > 0 {
+					return c.argsError("urls can't be combined with --input-file")
+				}
+				if output != "" || checksum != "" {
+					return c.argsError("--output and --checksum can't be combined with --input-file, set out= and checksum= per entry")
+				}
+				return runBatchCommand(inputFile, batchDefaults{Dir: dir, Headers: headers}, parallel, df)
+			}
+
+			for _, arg := range args {
+				if !isHTTPURL(arg) {
+					return c.argsError(fmt.Sprintf("'%s' is not an http or https url", arg))
+				}
+			}
+
+			switch {
+			case len(args) == 0:
+				return c.argsError("no url given")
+			case len(args) > 1:
+				if output != "" || checksum != "" {
+					return c.argsError("--output and --checksum need a single url")
+				}
+				entries := make([]batchEntry, len(args))
+				for i, url := range args {
+					entries[i] = batchEntry{URL: url}
+				}
+				return runEntries(entries, batchDefaults{Dir: dir, Headers: headers}, parallel, df)
+			}
+
+			url := args[0]
+			if !globOff {
+				matches, err := expandGlob(url)
+				if err == nil && checksum != "" {
+					return c.argsError("--checksum needs a single url, not a pattern")
+				}
+				if err == nil {
+					return runGlobCommand(url, matches, output, batchDefaults{Dir: dir, Headers: headers}, parallel, df)
+				}
+				if !errors.Is(err, ErrNoGlob) {
+					return c.argsError(err.Error())
+				}
+			}
+			return runGet(url, output, dir, headers, checksum, df)
+		}
+	},
+}
+
+var resumeCommand = &command{
+	name:    "resume",
+	usage:   "resume [options] <id|name>",
+	summary: "Continue a paused or failed download, named by its ID from 'adam ls' or its file name. It keeps the settings it was started with unless flags or --profile change them.",
+	setup: func(c *command, fs *pflag.FlagSet) func([]string) int {
+		wait := fs.Bool("wait", false, "wait if another adam is running this download")
+		df := addDownloadFlags(fs)
+		return func(args []string) int {
+			if len(args) != 1 {
+				return c.argsError("expected one session id or name")
+			}
+			return runResume(args[0], *wait, df)
+		}
+	},
+}
+
+var updateCommand = &command{
+	name:    "update",
+	usage:   "update <id|name> <new_url>",
+	summary: "Point a paused download at a new url, for links that expire.",
+	setup: func(c *command, fs *pflag.FlagSet) func([]string) int {
+		return func(args []string) int {
+			if len(args) != 2 {
+				return c.argsError("expected a session id or name and a url")
+			}
+			return updateSessionUrl(args[0], args[1])
+		}
+	},
+}
+
+var listCommand = &command{
+	name:    "ls",
+	aliases: []string{"list"},
+	usage:   "ls [options] [pattern...]",
+	summary: "List download sessions. Patterns are globs matched against the file name, like '*.iso'.",
+	setup: func(c *command, fs *pflag.FlagSet) func([]string) int {
+		complete := fs.BoolP("complete", "c", false, "only completed downloads")
+		ongoing := fs.Bool("ongoing", false, "only ongoing downloads")
+		host := fs.String("host", "", "only downloads from this host or its subdomains")
+		sortBy := fs.String("sort", "", "order by name, size, progress or date")
+		reverse := fs.BoolP("reverse", "r", false, "reverse the order")
+		wide := fs.BoolP("wide", "w", false, "show every column in full, the default when stdout is not a terminal")
+		asJSON := fs.Bool("json", false, "print the sessions as JSON, same as --format json")
+		format := fs.String("format", "", "table, wide, json or a Go template such as '{{.ID}} {{.Status}}'")
+		return func(args []string) int {
+			opts := listOptions{filter: "all", patterns: args, host: *host, sortBy: *sortBy, reverse: *reverse, format: *format}
+			switch {
+			case *complete && *ongoing:
+				return c.argsError("--complete and --ongoing can't be combined")
+			case *complete:
+				opts.filter = "complete"
+			case *ongoing:
+				opts.filter = "ongoing"
+			}
+			for _, pattern := range args {
+				if _, err := filepath.Match(pattern, ""); err != nil {
+					return c.argsError("invalid pattern '" + pattern + "'")
+				}
+			}
+
+			switch {
+			case *asJSON && opts.format != "" && opts.format != "json":
+				return c.argsError("--json and --format can't be combined")
+			case *asJSON:
+				opts.format = "json"
+			case opts.format != "":
+			case *wide || !stdoutIsTerminal():
+				opts.format = "wide"
+			default:
+				opts.format = "table"
+			}
+			return listSessions(opts)
+		}
+	},
+}
+
+var infoCommand = &command{
+	name:    "info",
+	usage:   "info <id|name>",
+	summary: "Show everything known about a download: url, path, parts, timestamps and speed.",
+	setup: func(c *command, fs *pflag.FlagSet) func([]string) int {
+		return func(args []string) int {
+			if len(args) != 1 {
+				return c.argsError("expected one session id or name")
+			}
+			return showSessionInfo(args[0])
+		}
+	},
+}
+
+var historyCommand = &command{
+	name:    "history",
+	usage:   "history [options] [search]",
+	summary: "List completed downloads with their timestamps and speeds. search matches the file name or url.",
+	setup: func(c *command, fs *pflag.FlagSet) func([]string) int {
+		host := fs.String("host", "", "only downloads from this host or its subdomains")
+		since := fs.String("since", "", "only downloads finished after a date (2006-01-02) or an age (7d)")
+		until := fs.String("until", "", "only downloads finished by the end of a date, or before an age")
+		sortBy := fs.String("sort", "date", "order by date, name, host, size, duration or speed")
+		reverse := fs.BoolP("reverse", "r", false, "reverse the order")
+		limit := fs.IntP("limit", "n", 0, "show at most this many downloads")
+		format := fs.String("format", "table", "output as table, json or csv")
+		return func(args []string) int {
+			if len(args) > 1 {
+				return c.argsError("unexpected argument '" + args[1] + "'")
+			}
+			q := historyQuery{host: *host, sortBy: *sortBy, reverse: *reverse, limit: *limit}
+			if len(args) == 1 {
+				q.text = args[0]
+			}
+			var err error
+			if *since != "" {
+				if q.since, err = parseWhen(*since, false); err != nil {
+					return c.argsError(err.Error())
+				}
+			}
+			if *until != "" {
+				if q.until, err = parseWhen(*until, true); err != nil {
+					return c.argsError(err.Error())
+				}
+			}
+			return showHistory(q, *format)
+		}
+	},
+}
+
+var rmCommand = &command{
+	name:    "rm",
+	aliases: []string{"remove"},
+	usage:   "rm [options] <id|name>...",
+	summary: "Remove downloads: an unfinished one with its part files, only the record of a completed one unless --delete-file is given.",
+	setup: func(c *command, fs *pflag.FlagSet) func([]string) int {
+		keepData := fs.Bool("keep-data", false, "leave the part files of an unfinished download")
+		deleteFile := fs.Bool("delete-file", false, "also delete the file of a completed download, unless a later one wrote the same path")
+		return func(args []string) int {
+			if len(args) == 0 {
+				return c.argsError("expected a session id or name")
+			}
+			code := exitOK
+			for _, ref := range args {
+				if rc := removeSession(ref, *keepData, *deleteFile); rc != exitOK {
+					code = rc
+				}
+			}
+			return code
+		}
+	},
+}
+
+var cleanCommand = &command{
+	name:    "clean",
+	usage:   "clean (--complete | --ongoing) [--older-than <age>]",
+	summary: "Remove old sessions. Completed ones only lose their record, the files stay. Unfinished ones lose their part files as well.",
+	setup: func(c *command, fs *pflag.FlagSet) func([]string) int {
+		complete := fs.BoolP("complete", "c", false, "remove completed sessions")
+		ongoing := fs.Bool("ongoing", false, "remove unfinished sessions that are not running")
+		olderThan := fs.String("older-than", "0s", "only sessions untouched for this long, e.g. 12h, 30d or 2w")
+		dryRun := fs.Bool("dry-run", false, "only show what would be removed")
+		return func(args []string) int {
+			if len(args) > 0 {
+				return c.argsError("unexpected argument '" + args[0] + "'")
+			}
+			if !*complete && !*ongoing {
+				return c.argsError("say what to clean with --complete or --ongoing")
+			}
+			age, err := util.ParseAge(*olderThan)
+			if err != nil {
+				return c.argsError(err.Error())
+			}
+			return cleanSessions(*complete, *ongoing, age, *dryRun)
+		}
+	},
+}
+
+var gcCommand = &command{
+	name:    "gc",
+	usage:   "gc [options] [dir...]",
+	summary: "Delete part files left next to finished downloads, sessions whose part files are gone and leftovers of crashed runs. With dirs, only part files in them are removed, and also those no download owns. Files adam did not download are never touched.",
+	setup: func(c *command, fs *pflag.FlagSet) func([]string) int {
+		dryRun := fs.Bool("dry-run", false, "only show what would be removed")
+		return func(args []string) int {
+			return collectGarbage(args, *dryRun)
+		}
+	},
+}
+
+var helpCommand = &command{
+	name:    "help",
+	usage:   "help [command]",
+	summary: "Show help for adam or one of its commands.",
+	setup: func(c *command, fs *pflag.FlagSet) func([]string) int {
+		return func(args []string) int {
+			if len(args) == 0 {
+				printHelp(os.Stdout)
+				return exitOK
+			}
+			target := findCommand(args[0])
+			if target == nil {
+				return c.argsError("unknown command '" + args[0] + "'")
+			}
+			tfs := pflag.NewFlagSet(target.name, pflag.ContinueOnError)
+			tfs.SortFlags = false
+			target.setup(target, tfs)
+			target.printHelp(os.Stdout, tfs)
+			return exitOK
+		}
+	},
+}
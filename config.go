@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anuraggr/adam/engine"
+	"github.com/anuraggr/adam/util"
+
+	"github.com/BurntSushi/toml"
+)
+
+// configFile is config.toml in the config dir. Top level keys are the
+// defaults, [profiles.<name>] tables override them per profile:
+//
+//	workers = "auto"
+//	max_workers = 12
+//	min_speed_for_restart = "100KB"
+//
+//	[profiles.mobile]
+//	workers = 2
+//	speed_check_interval = "10s"
+type configFile struct {
+	configValues
+	Profiles map[string]configValues `toml:"profiles"`
+}
+
+// configValues are pointers so that unset keys keep the value from the
+// layer below.
+type configValues struct {
+	Workers             *workers  `toml:"workers"`
+	MaxWorkers          *int      `toml:"max_workers"`
+	MaxConnPerHost      *int      `toml:"max_conn_per_host"`
+	HTTP1               *bool     `toml:"http1"`
+	HTTP3               *bool     `toml:"http3"`
+	IPVersion           *int      `toml:"ip_version"`
+	DNSServer           *string   `toml:"dns_server"`
+	Interfaces          *[]string `toml:"interfaces"`
+	BindAddresses       *[]string `toml:"bind_addresses"`
+	MaxRetries          *int      `toml:"max_retries"`
+	SpeedCheckInterval  *duration `toml:"speed_check_interval"`
+	MinSpeedForRestart  *byteSize `toml:"min_speed_for_restart"`
+	SlowWorkerThreshold *float64  `toml:"slow_worker_threshold"`
+	MaxWorkerRestarts   *int      `toml:"max_worker_restarts"`
+	MinPartSize         *byteSize `toml:"min_part_size"`
+	ConnectTimeout      *duration `toml:"connect_timeout"`
+	TLSTimeout          *duration `toml:"tls_timeout"`
+	HeaderTimeout       *duration `toml:"header_timeout"`
+	IdleTimeout         *duration `toml:"idle_timeout"`
+	BlockSize           *byteSize `toml:"block_size"`
+}
+
+// workers accepts a number or "auto".
+type workers struct {
+	auto bool
+	n    int
+}
+
+func (w *workers) UnmarshalTOML(v any) error {
+	switch v := v.(type) {
+	case int64:
+		w.n = int(v)
+		return nil
+	case string:
+		var err error
+		w.auto, w.n, err = parseWorkers(v)
+		return err
+	}
+	return fmt.Errorf("workers must be a number or \"auto\"")
+}
+
+// duration accepts "3s" style strings.
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// byteSize accepts a plain number of bytes or "100KB" style strings.
+type byteSize int64
+
+func (b *byteSize) UnmarshalText(text []byte) error {
+	v, err := util.ParseBytes(string(text))
+	if err != nil {
+		return err
+	}
+	*b = byteSize(v)
+	return nil
+}
+
+func configPath() string {
+	return filepath.Join(util.GetConfigDir(), "config.toml")
+}
+
+func (v configValues) apply(s *engine.Settings) {
+	if v.Workers != nil {
+		s.AutoWorkers = v.Workers.auto
+		if !v.Workers.auto {
+			s.Workers = v.Workers.n
+		}
+	}
+	if v.MaxWorkers != nil {
+		s.WorkerLimit = *v.MaxWorkers
+	}
+	if v.MaxConnPerHost != nil {
+		s.MaxConnPerHost = *v.MaxConnPerHost
+	}
+	if v.HTTP1 != nil {
+		s.HTTP1 = *v.HTTP1
+	}
+	if v.HTTP3 != nil {
+		s.HTTP3 = *v.HTTP3
+	}
+	if v.IPVersion != nil {
+		s.IPVersion = *v.IPVersion
+	}
+	if v.DNSServer != nil {
+		s.DNSServer = *v.DNSServer
+	}
+	if v.Interfaces != nil {
+		s.Interfaces = *v.Interfaces
+	}
+	if v.BindAddresses != nil {
+		s.BindAddresses = *v.BindAddresses
+	}
+	if v.MaxRetries != nil {
+		s.MaxRetries = *v.MaxRetries
+	}
+	if v.SpeedCheckInterval != nil {
+		s.SpeedCheckInterval = time.Duration(*v.SpeedCheckInterval)
+	}
+	if v.MinSpeedForRestart != nil {
+		s.MinMeanSpeedForRestart = float64(*v.MinSpeedForRestart)
+	}
+	if v.SlowWorkerThreshold != nil {
+		s.SlowWorkerThreshold = *v.SlowWorkerThreshold
+	}
+	if v.MaxWorkerRestarts != nil {
+		s.MaxWorkerRestarts = *v.MaxWorkerRestarts
+	}
+	if v.ConnectTimeout != nil {
+		s.ConnectTimeout = time.Duration(*v.ConnectTimeout)
+	}
+	if v.TLSTimeout != nil {
+		s.TLSTimeout = time.Duration(*v.TLSTimeout)
+	}
+	if v.HeaderTimeout != nil {
+		s.HeaderTimeout = time.Duration(*v.HeaderTimeout)
+	}
+	if v.IdleTimeout != nil {
+		s.IdleTimeout = time.Duration(*v.IdleTimeout)
+	}
+	if v.MinPartSize != nil {
+		s.MinPartSize = int64(*v.MinPartSize)
+	}
+	if v.BlockSize != nil {
+		s.BlockSize = int64(*v.BlockSize)
+	}
+}
+
+func readConfigFile(path string) (*configFile, error) {
+	var cfg configFile
+	md, err := toml.DecodeFile(path, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown key '%s'", undecoded[0])
+	}
+	return &cfg, nil
+}
+
+// loadSettings layers the built in defaults, the config file and the
+// named profile. A missing config file is fine unless a profile is
+// asked for.
+func loadSettings(profile string) (engine.Settings, error) {
+	settings := engine.DefaultSettings()
+	path := configPath()
+
+	cfg, err := readConfigFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if profile != "" {
+			return settings, fmt.Errorf("profile '%s' requested but %s does not exist", profile, path)
+		}
+		return settings, nil
+	}
+	if err != nil {
+		return settings, fmt.Errorf("%s: %v", path, err)
+	}
+
+	cfg.configValues.apply(&settings)
+	if profile != "" {
+		values, ok := cfg.Profiles[profile]
+		if !ok {
+			return settings, fmt.Errorf("no profile '%s' in %s (have: %s)", profile, path, profileNames(cfg))
+		}
+		values.apply(&settings)
+	}
+
+	if err := settings.Validate(); err != nil {
+		return settings, fmt.Errorf("%s: %v", path, err)
+	}
+	return settings, nil
+}
+
+func profileNames(cfg *configFile) string {
+	if len(cfg.Profiles) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(cfg.Profiles))
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,179 @@
+package engine
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+)
+
+// link is a local interface or source address that connections go out
+// from. With several of them the workers are spread over all, which
+// adds up the bandwidth of separate uplinks.
+type link struct {
+	name string
+	// addrs are the link's addresses, one is picked to match the
+	// family of the server address
+	addrs []netip.Addr
+	// device is the interface to bind to, empty for a plain address
+	device string
+
+	received atomic.Int64
+
+	// guarded by the dialer's mu
+	open int
+	// strikes counts the slow workers restarted on this link, each one
+	// costs it a connection when the next one is handed out
+	strikes int
+	last    int64
+	speed   float64
+}
+
+// parseLinks turns interface names and source addresses into links.
+func parseLinks(s Settings) ([]*link, error) {
+	var links []*link
+	for _, name := range s.Interfaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("unknown interface '%s'", name)
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("reading the addresses of '%s': %w", name, err)
+		}
+		l := &link{name: name, device: name}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip, ok := netip.AddrFromSlice(ipnet.IP)
+			// link-local addresses need a zone and reach no server
+			if !ok || ip.Unmap().IsLinkLocalUnicast() {
+				continue
+			}
+			l.addrs = append(l.addrs, ip.Unmap())
+		}
+		if len(l.addrs) == 0 {
+			return nil, fmt.Errorf("interface '%s' has no address", name)
+		}
+		links = append(links, l)
+	}
+	for _, a := range s.BindAddresses {
+		ip, err := netip.ParseAddr(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bind address '%s'", a)
+		}
+		links = append(links, &link{name: ip.String(), addrs: []netip.Addr{ip.Unmap()}})
+	}
+	return links, nil
+}
+
+// source is the address of l in the family of remote, false if it has
+// none.
+func (l *link) source(remote netip.Addr) (netip.Addr, bool) {
+	for _, a := range l.addrs {
+		if a.Is4() == remote.Is4() {
+			return a, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// pickLink takes the link with the fewest connections, counting its
+// strikes as connections, that can reach remote. It returns nil when
+// none can.
+func (d *dialer) pickLink(remote netip.Addr) (*link, netip.Addr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var best *link
+	var src netip.Addr
+	for _, l := range d.links {
+		a, ok := l.source(remote)
+		if !ok {
+			continue
+		}
+		if best == nil || l.open+l.strikes < best.open+best.strikes {
+			best, src = l, a
+		}
+	}
+	if best != nil {
+		best.open++
+	}
+	return best, src
+}
+
+func (d *dialer) releaseLink(l *link) {
+	d.mu.Lock()
+	l.open--
+	d.mu.Unlock()
+}
+
+// netDialer is the dialer for a connection from src on l.
+func (d *dialer) netDialer(l *link, src netip.Addr) *net.Dialer {
+	nd := d.net
+	nd.LocalAddr = &net.TCPAddr{IP: src.AsSlice()}
+	if l.device != "" {
+		nd.Control = func(_, _ string, c syscall.RawConn) error {
+			var err error
+			c.Control(func(fd uintptr) { err = bindToDevice(fd, l.device) })
+			return err
+		}
+	}
+	return &nd
+}
+
+// slow takes note that a worker on the connection conn was restarted
+// for being slow, so its link gets fewer connections from now on.
+func (d *dialer) slow(conn net.Conn) {
+	l := linkOf(conn)
+	if l == nil || len(d.links) < 2 {
+		return
+	}
+	d.mu.Lock()
+	l.strikes++
+	strikes := l.strikes
+	d.mu.Unlock()
+	d.debug(fmt.Sprintf("%s is slow, giving it fewer connections (strike %d)", l.name, strikes))
+}
+
+// linkOf is the link a connection of the dialer goes out from.
+func linkOf(conn net.Conn) *link {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if tc, ok := conn.(*trackedConn); ok {
+		return tc.link
+	}
+	return nil
+}
+
+// sample works out the speed of every link since the last call, which
+// was elapsed seconds ago.
+func (d *dialer) sample(elapsed float64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, l := range d.links {
+		received := l.received.Load()
+		l.speed = float64(received-l.last) / elapsed
+		l.last = received
+	}
+}
+
+// linkProgress reports the traffic of each link, nil without links.
+func (d *dialer) linkProgress() []LinkProgress {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var links []LinkProgress
+	for _, l := range d.links {
+		links = append(links, LinkProgress{
+			Name:        l.name,
+			BytesPerSec: l.speed,
+			Received:    l.received.Load(),
+			Connections: l.open,
+		})
+	}
+	return links
+}
@@ -0,0 +1,19 @@
+//go:build linux
+
+package engine
+
+import (
+	"errors"
+	"syscall"
+)
+
+// bindToDevice sends the traffic of fd out through device whatever the
+// routing table says. It takes CAP_NET_RAW, without it the source
+// address alone picks the route.
+func bindToDevice(fd uintptr, device string) error {
+	err := syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
+	if errors.Is(err, syscall.EPERM) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package engine
+
+// bindToDevice is only done on Linux. Elsewhere the source address of
+// the interface picks the route.
+func bindToDevice(fd uintptr, device string) error {
+	return nil
+}
@@ -0,0 +1,190 @@
+package engine
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParseLinks(t *testing.T) {
+	links, err := parseLinks(Settings{BindAddresses: []string{"192.0.2.1", "::ffff:192.0.2.2", "2001:db8::1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, l := range links {
+		got = append(got, fmt.Sprintf("%s=%v", l.name, l.addrs))
+	}
+	// the name is kept as given, the address is unmapped
+	if want := "[192.0.2.1=[192.0.2.1] ::ffff:192.0.2.2=[192.0.2.2] 2001:db8::1=[2001:db8::1]]"; fmt.Sprint(got) != want {
+		t.Errorf("links %v, want %s", got, want)
+	}
+
+	for _, s := range []Settings{
+		{BindAddresses: []string{"nowhere"}},
+		{Interfaces: []string{"nosuchif0"}},
+	} {
+		if _, err := parseLinks(s); err == nil {
+			t.Errorf("parseLinks(%+v) took it", s)
+		}
+	}
+
+	lo, err := loopback()
+	if err != nil {
+		t.Skip(err)
+	}
+	links, err = parseLinks(Settings{Interfaces: []string{lo}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[0].device != lo || len(links[0].addrs) == 0 {
+		t.Fatalf("links for %s: %+v", lo, links)
+	}
+	for _, a := range links[0].addrs {
+		if !a.IsLoopback() {
+			t.Errorf("%s has address %s", lo, a)
+		}
+	}
+}
+
+// loopback is the name of the loopback interface.
+func loopback() (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			return iface.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no loopback interface")
+}
+
+func TestPickLinkCountsStrikes(t *testing.T) {
+	d := newDialer(Settings{BindAddresses: []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}}, func(string) {})
+	a, b, v6 := d.links[0], d.links[1], d.links[2]
+	remote := netip.MustParseAddr("198.51.100.1")
+
+	pick := func() *link {
+		l, _ := d.pickLink(remote)
+		return l
+	}
+	if pick() != a || pick() != b {
+		t.Fatal("first two connections not spread over both links")
+	}
+	// each strike costs a connection
+	a.strikes = 2
+	for range 2 {
+		if l := pick(); l != b {
+			t.Errorf("picked %s with its strikes, want %s", l.name, b.name)
+		}
+	}
+	if l := pick(); l != a {
+		t.Errorf("picked %s on a tie, want the first link", l.name)
+	}
+	d.releaseLink(b)
+	if l := pick(); l != b {
+		t.Errorf("picked %s after %s lost a connection", l.name, b.name)
+	}
+
+	if l, src := d.pickLink(netip.MustParseAddr("2001:db8::2")); l != v6 || src != v6.addrs[0] {
+		t.Errorf("IPv6 server got link %v from %s", l, src)
+	}
+	d = newDialer(Settings{BindAddresses: []string{"192.0.2.1"}}, func(string) {})
+	if l, _ := d.pickLink(netip.MustParseAddr("2001:db8::2")); l != nil {
+		t.Errorf("IPv6 server reached over %s", l.name)
+	}
+}
+
+func TestSlowStrikesTheLinkOfConn(t *testing.T) {
+	var debug []string
+	d := newDialer(Settings{BindAddresses: []string{"192.0.2.1", "192.0.2.2"}}, func(msg string) { debug = append(debug, msg) })
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conn := &trackedConn{Conn: c1, link: d.links[1], done: func() {}}
+
+	d.slow(conn)
+	// TLS connections are found under their wrapping
+	d.slow(tls.Client(conn, &tls.Config{}))
+	// a connection the dialer did not make has no link
+	d.slow(c2)
+	if d.links[0].strikes != 0 || d.links[1].strikes != 2 {
+		t.Errorf("strikes %d and %d, want 0 and 2", d.links[0].strikes, d.links[1].strikes)
+	}
+	if len(debug) != 2 || !strings.Contains(debug[1], "192.0.2.2 is slow") {
+		t.Errorf("debug %q", debug)
+	}
+
+	// with a single link there is nothing to shift to
+	d = newDialer(Settings{BindAddresses: []string{"192.0.2.1"}}, func(string) {})
+	d.slow(&trackedConn{Conn: c1, link: d.links[0], done: func() {}})
+	if d.links[0].strikes != 0 {
+		t.Errorf("single link got %d strikes", d.links[0].strikes)
+	}
+}
+
+func TestSeveralLinksUseHTTP1(t *testing.T) {
+	tests := []struct {
+		settings Settings
+		http2    bool
+	}{
+		{settings: Settings{}, http2: true},
+		{settings: Settings{BindAddresses: []string{"192.0.2.1"}}, http2: true},
+		{settings: Settings{BindAddresses: []string{"192.0.2.1", "192.0.2.2"}}, http2: false},
+		{settings: Settings{BindAddresses: []string{"192.0.2.1", "192.0.2.2"}, HTTP3: true}, http2: false},
+	}
+	for _, tt := range tests {
+		var debug []string
+		client := newClient(tt.settings, newDialer(tt.settings, func(msg string) { debug = append(debug, msg) }))
+		tr, ok := client.Transport.(*http.Transport)
+		if !ok {
+			t.Errorf("%+v: transport %T, want TCP only", tt.settings, client.Transport)
+			continue
+		}
+		if http2 := tr.TLSNextProto == nil; http2 != tt.http2 {
+			t.Errorf("%+v: HTTP/2 %v, want %v (debug %q)", tt.settings, http2, tt.http2, debug)
+		}
+	}
+}
+
+func TestDownloadOverTwoAddresses(t *testing.T) {
+	// only Linux has all of 127/8 on loopback
+	if ln, err := net.Listen("tcp", "127.0.0.2:0"); err != nil {
+		t.Skipf("no 127.0.0.2: %v", err)
+	} else {
+		ln.Close()
+	}
+	s, srv := newFileServer(t, 4<<20)
+	rec := &recorder{}
+	opts := testOptions(t, rec)
+	opts.Workers = 4
+	opts.BindAddresses = []string{"127.0.0.1", "127.0.0.2"}
+
+	d, err := download(t, srv.URL+"/file.bin", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, d.State().Filename, s.data)
+
+	links := d.Progress().Links
+	if len(links) != 2 {
+		t.Fatalf("progress has %d links, want 2", len(links))
+	}
+	var total int64
+	for _, l := range links {
+		if l.Received == 0 {
+			t.Errorf("nothing received over %s: %+v", l.Name, links)
+		}
+		total += l.Received
+	}
+	// headers come on top of the file
+	if total < int64(len(s.data)) {
+		t.Errorf("links received %d bytes, less than the %d of the file", total, len(s.data))
+	}
+}
@@ -0,0 +1,76 @@
+package engine
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// newHash maps an aria2 style digest name (sha-256, md5, ...) to a hash.
+func newHash(algo string) (hash.Hash, error) {
+	switch strings.ToLower(algo) {
+	case "md5":
+		return md5.New(), nil
+	case "sha-1", "sha1":
+		return sha1.New(), nil
+	case "sha-224", "sha224":
+		return sha256.New224(), nil
+	case "sha-256", "sha256":
+		return sha256.New(), nil
+	case "sha-384", "sha384":
+		return sha512.New384(), nil
+	case "sha-512", "sha512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported checksum type: %s", algo)
+}
+
+// parseChecksum splits "<type>=<hex digest>" and validates the type.
+func parseChecksum(spec string) (string, string, error) {
+	algo, digest, ok := strings.Cut(spec, "=")
+	if !ok || digest == "" {
+		return "", "", fmt.Errorf("invalid checksum %q, expected <type>=<digest>", spec)
+	}
+	if _, err := newHash(algo); err != nil {
+		return "", "", err
+	}
+	return algo, strings.ToLower(digest), nil
+}
+
+// digestHash returns the hash to run over the merged file. It is the
+// type of the expected checksum, sha-256 when there is none.
+func digestHash(spec string) (string, hash.Hash) {
+	algo := "sha-256"
+	if spec != "" {
+		if a, _, err := parseChecksum(spec); err == nil {
+			algo = strings.ToLower(a)
+		}
+	}
+	h, _ := newHash(algo)
+	return algo, h
+}
+
+// checkDigest compares the digest of the merged file with spec.
+func checkDigest(spec string, got string) error {
+	algo, want, err := parseChecksum(spec)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("%w: %s expected %s, got %s", ErrChecksumMismatch, algo, want, got)
+	}
+	return nil
+}
+
+// ValidateChecksum checks a "<type>=<digest>" spec without hashing.
+func ValidateChecksum(spec string) error {
+	_, _, err := parseChecksum(spec)
+	return err
+}
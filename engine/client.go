@@ -0,0 +1,198 @@
+package engine
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Timeouts used when the Settings leave them at 0.
+const (
+	DefaultConnectTimeout = 15 * time.Second
+	DefaultTLSTimeout     = 15 * time.Second
+	DefaultHeaderTimeout  = 30 * time.Second
+	DefaultIdleTimeout    = 30 * time.Second
+)
+
+// errStalled is returned when a response body sends nothing for the
+// idle timeout. The part is asked for again from its offset.
+var errStalled = errors.New("connection stalled")
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+// newClient builds the HTTP client of a download, shared by the probe
+// and every worker so connections are kept alive between requests.
+// Its timeouts cover setting up the connection and waiting for the
+// response headers; the body is read under the idle timeout, see
+// idleTimer. With s.HTTP3 requests go over QUIC until it fails once.
+// Connections are made by dialer, whose debug hears about fallbacks.
+func newClient(s Settings, dialer *dialer) *http.Client {
+	debug := dialer.debug
+	http1, overQUIC := s.HTTP1, s.HTTP3
+	if len(dialer.links) > 0 && overQUIC {
+		debug("HTTP/3 is not bound to local addresses, using TCP")
+		overQUIC = false
+	}
+	if len(dialer.links) > 1 && !http1 {
+		// HTTP/2 would carry every worker over one link
+		debug(fmt.Sprintf("Using HTTP/1.1 to spread the connections over %d links", len(dialer.links)))
+		http1 = true
+	}
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   orDefault(s.TLSTimeout, DefaultTLSTimeout),
+		ResponseHeaderTimeout: orDefault(s.HeaderTimeout, DefaultHeaderTimeout),
+		// every worker keeps its connection between parts and retries,
+		// the default of 2 idle ones per host would close the rest
+		MaxIdleConns:        MaxWorkers,
+		MaxIdleConnsPerHost: MaxWorkers,
+		IdleConnTimeout:     90 * time.Second,
+		// the bytes on disk must be the bytes of the file
+		DisableCompression: true,
+		ForceAttemptHTTP2:  !http1,
+	}
+	if http1 {
+		// a non-nil empty map is how net/http is told not to use HTTP/2
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if !overQUIC {
+		return &http.Client{Transport: t}
+	}
+
+	h3 := &http3.Transport{
+		QUICConfig: &quic.Config{
+			HandshakeIdleTimeout: orDefault(s.ConnectTimeout, DefaultConnectTimeout),
+			MaxIdleTimeout:       orDefault(s.IdleTimeout, DefaultIdleTimeout),
+		},
+		DisableCompression: true,
+		Dial:               dialer.dialQUIC,
+	}
+	return &http.Client{Transport: &quicTransport{h3: h3, tcp: t, debug: debug}}
+}
+
+// quicTransport sends requests over HTTP/3 and falls back to tcp, for
+// good, the first time QUIC does not get an answer: UDP is blocked or
+// the server does not speak it. Plain http urls always go over tcp.
+type quicTransport struct {
+	h3     *http3.Transport
+	tcp    *http.Transport
+	debug  func(string)
+	failed atomic.Bool
+}
+
+func (q *quicTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" || q.failed.Load() {
+		return q.tcp.RoundTrip(req)
+	}
+	resp, err := q.h3.RoundTrip(req)
+	if err == nil || req.Context().Err() != nil {
+		return resp, err
+	}
+	if q.failed.CompareAndSwap(false, true) {
+		q.debug(fmt.Sprintf("HTTP/3 failed, using TCP: %v", err))
+	}
+	return q.tcp.RoundTrip(req)
+}
+
+// connStats follows the connections the workers read from and the
+// protocol spoken on them. Over HTTP/2 all workers share one
+// connection, so more workers do not mean more bandwidth.
+type connStats struct {
+	mu    sync.Mutex
+	conns map[net.Conn]int
+	proto string
+	// active counts the requests in flight
+	active int
+}
+
+// trace returns ctx with a trace that counts the connection req gets,
+// and a func to call once the response is read.
+func (c *connStats) trace(ctx context.Context) (context.Context, func()) {
+	var conn net.Conn
+	c.mu.Lock()
+	c.active++
+	c.mu.Unlock()
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.conns == nil {
+				c.conns = make(map[net.Conn]int)
+			}
+			conn = info.Conn
+			c.conns[conn]++
+		},
+	}
+	done := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.active--
+		if conn == nil {
+			return
+		}
+		if c.conns[conn]--; c.conns[conn] <= 0 {
+			delete(c.conns, conn)
+		}
+	}
+	return httptrace.WithClientTrace(ctx, trace), done
+}
+
+func (c *connStats) setProto(proto string) {
+	c.mu.Lock()
+	c.proto = proto
+	c.mu.Unlock()
+}
+
+func (c *connStats) get() (proto string, conns int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conns = len(c.conns)
+	// QUIC has no net.Conn to trace, its streams share one connection
+	if conns == 0 && c.active > 0 && strings.HasPrefix(c.proto, "HTTP/3") {
+		conns = 1
+	}
+	return c.proto, conns
+}
+
+// idleTimer cancels a request whose body goes silent. Each read is
+// timed on its own, so pauses and rate limiting between reads do not
+// count.
+type idleTimer struct {
+	timer   *time.Timer
+	timeout time.Duration
+	fired   atomic.Bool
+}
+
+func newIdleTimer(timeout time.Duration, cancel func()) *idleTimer {
+	t := &idleTimer{timeout: timeout}
+	t.timer = time.AfterFunc(timeout, func() {
+		t.fired.Store(true)
+		cancel()
+	})
+	t.timer.Stop()
+	return t
+}
+
+// start times the next read, stop ends it.
+func (t *idleTimer) start() { t.timer.Reset(t.timeout) }
+func (t *idleTimer) stop()  { t.timer.Stop() }
+
+// stalled reports whether the timer cancelled the request.
+func (t *idleTimer) stalled() bool { return t.fired.Load() }
@@ -0,0 +1,218 @@
+package engine
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newTLSServers serves s over HTTP/2 on TCP, and with quic over
+// HTTP/3 on the same port, from a certificate for 127.0.0.1.
+func newTLSServers(t *testing.T, s *fileServer, quic bool) *httptest.Server {
+	srv := httptest.NewUnstartedServer(s)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	if !quic {
+		return srv
+	}
+
+	conn, err := net.ListenPacket("udp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Skipf("no UDP port next to the TCP one: %v", err)
+	}
+	h3 := &http3.Server{
+		Handler:   s,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: srv.TLS.Certificates}),
+	}
+	go h3.Serve(conn)
+	t.Cleanup(func() {
+		h3.Close()
+		conn.Close()
+	})
+	return srv
+}
+
+// newWithClient sets up a download of srv like New does, over a
+// client that trusts the certificate of srv.
+func newWithClient(t *testing.T, srv *httptest.Server, opts Options) *Downloader {
+	t.Helper()
+	dialer := newDialer(opts.Settings, opts.debug)
+	client := newClient(opts.Settings, dialer)
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	switch tr := client.Transport.(type) {
+	case *quicTransport:
+		tr.h3.TLSClientConfig = &tls.Config{RootCAs: roots}
+		tr.tcp.TLSClientConfig = &tls.Config{RootCAs: roots}
+	case *http.Transport:
+		tr.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	url := srv.URL + "/file.bin"
+	size, server, err := checkServerSupport(ctx, client, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &DownloadState{
+		Created:   time.Now(),
+		ID:        NewSessionID(),
+		URL:       url,
+		Filename:  filepath.Join(t.TempDir(), "file.bin"),
+		TotalSize: size,
+		Server:    server,
+	}
+	d := newDownloader(state, opts, client, dialer)
+	state.Parts = d.planner.plan(size, opts.Workers)
+	return d
+}
+
+// runWithClient downloads from srv over a client that trusts it.
+func runWithClient(t *testing.T, srv *httptest.Server, opts Options) (*Downloader, error) {
+	t.Helper()
+	d := newWithClient(t, srv, opts)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return d, d.Run(ctx)
+}
+
+func TestHTTP3Download(t *testing.T) {
+	s := &fileServer{data: make([]byte, 4<<20)}
+	copy(s.data, strings.Repeat("adam over quic ", 1<<18))
+	srv := newTLSServers(t, s, true)
+	rec := &recorder{}
+	opts := testOptions(t, rec)
+	opts.Workers = 4
+	opts.HTTP3 = true
+
+	d, err := runWithClient(t, srv, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, d.State().Filename, s.data)
+
+	if proto := d.State().Server.Protocol; proto != "HTTP/3.0" {
+		t.Errorf("probe answered over %s, want HTTP/3.0", proto)
+	}
+	for _, p := range d.State().Parts {
+		if p.Protocol != "HTTP/3.0" {
+			t.Errorf("part %d came over %s, want HTTP/3.0", p.ID, p.Protocol)
+		}
+	}
+	if d.client.Transport.(*quicTransport).failed.Load() {
+		t.Errorf("fell back to TCP: %v", rec.debug())
+	}
+}
+
+func TestHTTP3FallsBackToTCP(t *testing.T) {
+	s := &fileServer{data: make([]byte, 4<<20)}
+	// nothing listens for QUIC
+	srv := newTLSServers(t, s, false)
+	rec := &recorder{}
+	opts := testOptions(t, rec)
+	opts.Workers = 4
+	opts.HTTP3 = true
+	opts.ConnectTimeout = 500 * time.Millisecond
+
+	d, err := runWithClient(t, srv, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, d.State().Filename, s.data)
+
+	for _, p := range d.State().Parts {
+		if p.Protocol != "HTTP/2.0" {
+			t.Errorf("part %d came over %s, want HTTP/2.0", p.ID, p.Protocol)
+		}
+	}
+	fallbacks := 0
+	for _, msg := range rec.debug() {
+		if strings.HasPrefix(msg, "HTTP/3 failed, using TCP") {
+			fallbacks++
+		}
+	}
+	if fallbacks != 1 {
+		t.Errorf("%d fallbacks reported, want 1: %v", fallbacks, rec.debug())
+	}
+}
+
+func TestHTTP2CarriesWorkersOverOneConnection(t *testing.T) {
+	tests := []struct {
+		http1 bool
+		proto string
+		conns int
+	}{
+		{http1: false, proto: "HTTP/2.0", conns: 1},
+		{http1: true, proto: "HTTP/1.1", conns: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proto, func(t *testing.T) {
+			s := &fileServer{data: make([]byte, 4<<20)}
+			s.pace = func(int64) time.Duration { return 20 * time.Millisecond }
+			srv := newTLSServers(t, s, false)
+			opts := testOptions(t, &recorder{})
+			opts.Workers = 4
+			opts.HTTP1 = tt.http1
+
+			d := newWithClient(t, srv, opts)
+			done := make(chan error, 1)
+			go func() { done <- d.Run(context.Background()) }()
+			most, proto := 0, ""
+		watch:
+			for {
+				select {
+				case err := <-done:
+					if err != nil {
+						t.Fatal(err)
+					}
+					break watch
+				case <-time.After(10 * time.Millisecond):
+					p := d.Progress()
+					most = max(most, p.Connections)
+					if p.Protocol != "" {
+						proto = p.Protocol
+					}
+				}
+			}
+			checkFile(t, d.State().Filename, s.data)
+
+			if most != tt.conns || proto != tt.proto {
+				t.Errorf("progress showed at most %d connections over %s, want %d over %s", most, proto, tt.conns, tt.proto)
+			}
+			// the probe's connection is kept for a worker
+			if got := s.connections(); got != tt.conns {
+				t.Errorf("server saw %d connections, want %d", got, tt.conns)
+			}
+		})
+	}
+}
+
+func TestProbeConnectionIsReused(t *testing.T) {
+	s, srv := newFileServer(t, 4<<20)
+	// slow enough that no worker finishes before the last one starts
+	s.pace = func(int64) time.Duration { return 10 * time.Millisecond }
+	opts := testOptions(t, &recorder{})
+	opts.Workers = 4
+
+	d, err := download(t, srv.URL+"/file.bin", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, d.State().Filename, s.data)
+	// New hands its client on to the workers, one of them gets the
+	// connection of the probe
+	if got := s.connections(); got != 4 {
+		t.Errorf("server saw %d connections, want 4 for the probe and 4 parts", got)
+	}
+}
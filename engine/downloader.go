@@ -0,0 +1,985 @@
+package engine
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anuraggr/adam/util"
+)
+
+// Settings are the tuning knobs of a download. They are saved with
+// the session so that a resume runs with the same configuration.
+type Settings struct {
+	Workers                int           `json:"workers"`
+	MaxRetries             int           `json:"max_retries"`
+	SpeedCheckInterval     time.Duration `json:"speed_check_interval"`
+	MinMeanSpeedForRestart float64       `json:"min_mean_speed_for_restart"`
+	SlowWorkerThreshold    float64       `json:"slow_worker_threshold"`
+	MaxWorkerRestarts      int           `json:"max_worker_restarts"`
+	// RateLimit caps the combined speed in bytes per second, 0 is none.
+	RateLimit int64 `json:"rate_limit,omitempty"`
+	// AutoWorkers starts with a few connections and adds more while the
+	// throughput keeps growing, up to WorkerLimit (DefaultWorkerLimit if
+	// 0). Workers is ignored then.
+	AutoWorkers bool `json:"auto_workers,omitempty"`
+	WorkerLimit int  `json:"worker_limit,omitempty"`
+	// MinPartSize is the smallest part worth its own connection,
+	// DefaultMinPartSize if 0. Files under twice that use one.
+	MinPartSize int64 `json:"min_part_size,omitempty"`
+	// BlockSize puts part boundaries on its multiples, e.g. the block
+	// size the server stores the file in. HTTP has no header for that,
+	// so it is never taken from the server. 4 KiB if 0.
+	BlockSize int64 `json:"block_size,omitempty"`
+	// MaxConnPerHost caps the connections to the server, in place of
+	// the limit learned from it before. 0 uses the learned one.
+	MaxConnPerHost int `json:"max_conn_per_host,omitempty"`
+	// HTTP1 keeps to HTTP/1.1, which gives every worker a connection of
+	// its own where HTTP/2 would share one between them.
+	HTTP1 bool `json:"http1,omitempty"`
+	// HTTP3 tries QUIC first for https urls, for links with high
+	// latency or loss. It falls back to TCP if QUIC fails.
+	HTTP3 bool `json:"http3,omitempty"`
+	// Resolve pins host:port to addresses, curl style
+	// "host:port:addr[,addr...]", instead of looking it up.
+	Resolve []string `json:"resolve,omitempty"`
+	// IPVersion keeps to IPv4 or IPv6 addresses when 4 or 6.
+	IPVersion int `json:"ip_version,omitempty"`
+	// DNSServer looks hosts up on this server ("1.1.1.1", "[::1]:53")
+	// or DNS-over-HTTPS url instead of the system resolver.
+	DNSServer string `json:"dns_server,omitempty"`
+	// Interfaces and BindAddresses are local interfaces ("eth0") and
+	// source addresses to connect from. The workers are spread over
+	// them so separate uplinks add up, and the slower ones get fewer.
+	Interfaces    []string `json:"interfaces,omitempty"`
+	BindAddresses []string `json:"bind_addresses,omitempty"`
+	// Timeouts for connecting, the TLS handshake, the response headers
+	// and each read of the body, the Default ones where 0. A body that
+	// sends nothing for IdleTimeout is asked for again from where it
+	// stopped.
+	ConnectTimeout time.Duration `json:"connect_timeout,omitempty"`
+	TLSTimeout     time.Duration `json:"tls_timeout,omitempty"`
+	HeaderTimeout  time.Duration `json:"header_timeout,omitempty"`
+	IdleTimeout    time.Duration `json:"idle_timeout,omitempty"`
+}
+
+// Options controls a download. Start from DefaultOptions and change
+// what you need.
+type Options struct {
+	Settings
+
+	// Headers are extra request headers in "Name: value" form.
+	Headers []string
+	// Checksum is verified after the merge, "<type>=<hex digest>".
+	Checksum string
+	// Group ties sessions created from one url pattern together, and
+	// GroupName is what the group is shown as.
+	Group     string
+	GroupName string
+
+	// Store persists the session, a FileStore in the config dir if nil.
+	Store Store
+	// OnEvent receives progress events. It is called from several
+	// goroutines and must not block.
+	OnEvent func(Event)
+}
+
+// MaxWorkers bounds the connections per download, more only gets a
+// client throttled or banned.
+const MaxWorkers = 64
+
+func DefaultSettings() Settings {
+	return Settings{
+		Workers:                8,
+		MaxRetries:             3,
+		SpeedCheckInterval:     3 * time.Second,
+		MinMeanSpeedForRestart: 100 * 1024,
+		SlowWorkerThreshold:    0.3,
+		MaxWorkerRestarts:      5,
+	}
+}
+
+func DefaultOptions() Options {
+	return Options{Settings: DefaultSettings()}
+}
+
+// Validate reports settings that would break the engine.
+func (s Settings) Validate() error {
+	switch {
+	case s.Workers < 1:
+		return fmt.Errorf("workers must be at least 1, got %d", s.Workers)
+	case s.Workers > MaxWorkers:
+		return fmt.Errorf("workers can't exceed %d, got %d", MaxWorkers, s.Workers)
+	case s.MaxRetries < 1:
+		return fmt.Errorf("retries must be at least 1, got %d", s.MaxRetries)
+	case s.SpeedCheckInterval <= 0:
+		return fmt.Errorf("speed check interval must be positive, got %s", s.SpeedCheckInterval)
+	case s.MinMeanSpeedForRestart < 0:
+		return fmt.Errorf("restart speed threshold can't be negative")
+	case s.SlowWorkerThreshold <= 0 || s.SlowWorkerThreshold > 1:
+		return fmt.Errorf("slow worker threshold must be in (0, 1], got %g", s.SlowWorkerThreshold)
+	case s.MaxWorkerRestarts < 0:
+		return fmt.Errorf("worker restarts can't be negative, got %d", s.MaxWorkerRestarts)
+	case s.RateLimit < 0:
+		return fmt.Errorf("rate limit can't be negative")
+	case s.WorkerLimit < 0 || s.WorkerLimit > MaxWorkers:
+		return fmt.Errorf("worker limit must be between 1 and %d, got %d", MaxWorkers, s.WorkerLimit)
+	case s.MaxConnPerHost < 0 || s.MaxConnPerHost > MaxWorkers:
+		return fmt.Errorf("connections per host must be between 1 and %d, got %d", MaxWorkers, s.MaxConnPerHost)
+	case s.ConnectTimeout < 0 || s.TLSTimeout < 0 || s.HeaderTimeout < 0 || s.IdleTimeout < 0:
+		return fmt.Errorf("timeouts can't be negative")
+	case s.IPVersion != 0 && s.IPVersion != 4 && s.IPVersion != 6:
+		return fmt.Errorf("IP version must be 4 or 6, got %d", s.IPVersion)
+	case s.MinPartSize < 0:
+		return fmt.Errorf("minimum part size can't be negative")
+	case s.BlockSize < 0:
+		return fmt.Errorf("block size can't be negative")
+	}
+	for _, entry := range s.Resolve {
+		if _, _, err := parseResolve(entry); err != nil {
+			return err
+		}
+	}
+	if _, err := parseLinks(s); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Downloader runs a single download session.
+type Downloader struct {
+	opts    Options
+	state   *DownloadState
+	store   Store
+	tracker *tracker
+	limiter *rateLimiter
+	planner planner
+	client  *http.Client
+	dialer  *dialer
+	conns   connStats
+	// hostCap is the most connections the host takes, 0 if unknown,
+	// and hostReason why
+	hostCap    int
+	hostReason string
+	// throttled counts the times the server pushed back in this run
+	throttled atomic.Int32
+
+	// partMu guards CurrentOffset and IsComplete of the parts, workers
+	// move them while the state is being saved
+	partMu sync.Mutex
+	// saveMu keeps saves in order so an older snapshot never replaces
+	// a newer one
+	saveMu sync.Mutex
+	// unlock releases the session lock, nil if the store has none
+	unlock func()
+	// runStart is when the current Run began, zero when not running.
+	// Guarded by partMu like the elapsed time it feeds.
+	runStart time.Time
+
+	// set up by Run
+	runCtx      context.Context
+	wg          sync.WaitGroup
+	downloadErr error
+	errMu       sync.Mutex
+	// failed is closed once downloadErr is set
+	failed    chan struct{}
+	workerCtx map[int]*workerControl
+	ctxMu     sync.RWMutex
+	// pool hands out the connections, parts beyond its limit wait
+	pool  *workerPool
+	tuner *tuner
+	// outstanding counts worker goroutines, running or waiting. spawnMu
+	// keeps new ones from starting once it is back to zero and Run is
+	// past waiting for them.
+	spawnMu     sync.Mutex
+	outstanding int
+	// parked are the parts that failed and wait to be tried again,
+	// guarded by spawnMu
+	parked []*Part
+}
+
+type workerControl struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	// restart is set when the worker is cancelled to start over
+	restart atomic.Bool
+}
+
+func newDownloader(state *DownloadState, opts Options, client *http.Client, dialer *dialer) *Downloader {
+	if opts.Store == nil {
+		opts.Store = NewFileStore()
+	}
+	settings := opts.Settings
+	state.Settings = &settings
+	hostCap, hostReason := hostLimit(state, opts)
+	return &Downloader{
+		opts:       opts,
+		state:      state,
+		store:      opts.Store,
+		tracker:    newTracker(),
+		limiter:    newRateLimiter(opts.RateLimit),
+		planner:    newPlanner(settings),
+		client:     client,
+		dialer:     dialer,
+		hostCap:    hostCap,
+		hostReason: hostReason,
+	}
+}
+
+// New probes url, splits the file into parts and saves a fresh session
+// that writes to filename. An unfinished session for the same output
+// path is discarded, it would share the part files.
+func New(ctx context.Context, url string, filename string, opts Options) (*Downloader, error) {
+	if err := opts.Settings.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Store == nil {
+		opts.Store = NewFileStore()
+	}
+
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	sessions, _ := opts.Store.List(false)
+	for _, old := range sessions {
+		if old.Filename != filename {
+			continue
+		}
+		if locker, ok := opts.Store.(Locker); ok {
+			if info, held := locker.Holder(old.ID); held {
+				return nil, &LockedError{ID: old.ID, Info: *info}
+			}
+		}
+		opts.Store.Delete(old.ID)
+	}
+	util.CleanupTempFiles(filename)
+
+	if opts.AutoWorkers {
+		opts.Workers = autoStartWorkers
+	}
+	dialer := newDialer(opts.Settings, opts.debug)
+	client := newClient(opts.Settings, dialer)
+	totalSize, server, err := checkServerSupport(ctx, client, url, opts.Headers)
+	rangeSupport := err == nil
+	if err == ErrNoRangeSupport {
+		opts.Workers = 1
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &DownloadState{
+		Created:   time.Now(),
+		ID:        NewSessionID(),
+		URL:       url,
+		Filename:  filename,
+		TotalSize: totalSize,
+		Headers:   opts.Headers,
+		Checksum:  opts.Checksum,
+		Group:     opts.Group,
+		GroupName: opts.GroupName,
+		Server:    server,
+	}
+
+	d := newDownloader(state, opts, client, dialer)
+	state.Parts = d.planner.plan(totalSize, d.capWorkers(opts.Workers))
+	if err := d.lock(); err != nil {
+		return nil, err
+	}
+	d.emit(ProbeEvent{URL: url, TotalSize: totalSize, RangeSupport: rangeSupport, Protocol: server.Protocol})
+	if err := d.Save(); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Open finds a paused session by ID or name (see FindSession) and
+// resumes it with the settings it was started with.
+func Open(ref string, opts Options) (*Downloader, error) {
+	if opts.Store == nil {
+		opts.Store = NewFileStore()
+	}
+	state, err := FindSession(opts.Store, ref)
+	if err != nil {
+		return nil, err
+	}
+	if state.Settings != nil {
+		opts.Settings = *state.Settings
+	}
+	return Resume(state, opts)
+}
+
+// Resume continues a loaded session with opts. With more workers than
+// unfinished parts the remaining ranges are split up, with fewer the
+// parts take turns. AutoWorkers starts over from a few workers. It
+// fails with a LockedError when another process is running the session.
+func Resume(state *DownloadState, opts Options) (*Downloader, error) {
+	if err := opts.Settings.Validate(); err != nil {
+		return nil, err
+	}
+	dialer := newDialer(opts.Settings, opts.debug)
+	d := newDownloader(state, opts, newClient(opts.Settings, dialer), dialer)
+	if err := d.lock(); err != nil {
+		return nil, err
+	}
+	workers := opts.Workers
+	if opts.AutoWorkers {
+		workers = autoStartWorkers
+	}
+	if splitParts(state, d.capWorkers(workers), d.planner) {
+		if err := d.Save(); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *Downloader) lock() error {
+	locker, ok := d.store.(Locker)
+	if !ok {
+		return nil
+	}
+	unlock, err := locker.Lock(d.state.ID)
+	if err != nil {
+		return err
+	}
+	d.unlock = unlock
+	return nil
+}
+
+// Close releases the session for other processes. Call it once the
+// downloader is no longer used, after Run and any Save or Discard.
+func (d *Downloader) Close() {
+	if d.unlock != nil {
+		d.unlock()
+		d.unlock = nil
+	}
+}
+
+// State returns the session state. It is updated while Run is active.
+func (d *Downloader) State() *DownloadState {
+	return d.state
+}
+
+func (d *Downloader) Pause()         { d.tracker.pause() }
+func (d *Downloader) Resume()        { d.tracker.resume() }
+func (d *Downloader) IsPaused() bool { return d.tracker.isPaused() }
+
+func (d *Downloader) Progress() Progress {
+	p := Progress{
+		TotalSize: d.state.TotalSize,
+		Received:  d.tracker.totalReceived(),
+		Parts:     d.tracker.snapshot(),
+	}
+	p.Protocol, p.Connections = d.conns.get()
+	p.Links = d.dialer.linkProgress()
+	return p
+}
+
+// Save writes the current state to the store. It is safe to call while
+// Run is active.
+func (d *Downloader) Save() error {
+	d.saveMu.Lock()
+	defer d.saveMu.Unlock()
+	return d.store.Save(d.snapshot())
+}
+
+// snapshot copies the state with its parts, so it can be encoded while
+// the workers keep going.
+func (d *Downloader) snapshot() *DownloadState {
+	d.partMu.Lock()
+	defer d.partMu.Unlock()
+
+	s := *d.state
+	if !d.runStart.IsZero() {
+		s.Elapsed += time.Since(d.runStart)
+	}
+	s.Parts = make([]*Part, len(d.state.Parts))
+	for i, p := range d.state.Parts {
+		s.Parts[i] = &Part{
+			ID:            p.ID,
+			Start:         p.Start,
+			End:           p.End,
+			CurrentOffset: p.CurrentOffset,
+			IsComplete:    p.IsComplete,
+			RetryCount:    p.RetryCount,
+			RestartCount:  p.RestartCount,
+			Protocol:      p.Protocol,
+		}
+	}
+	return &s
+}
+
+// setOffset publishes how much of a part is safely on disk. Callers
+// sync the part file first, so saved state never runs ahead of it.
+func (d *Downloader) setOffset(part *Part, offset int64) {
+	d.partMu.Lock()
+	part.CurrentOffset = offset
+	d.partMu.Unlock()
+}
+
+func (d *Downloader) markComplete(part *Part) {
+	d.partMu.Lock()
+	part.IsComplete = true
+	d.partMu.Unlock()
+}
+
+// recordFailure saves why the run failed, so listings can tell a failed
+// download from a paused one.
+func (d *Downloader) recordFailure(err error) {
+	d.partMu.Lock()
+	d.state.LastError = err.Error()
+	d.state.LinkExpired = errors.Is(err, ErrLinkExpired)
+	d.partMu.Unlock()
+	d.Save()
+}
+
+// stopClock adds the time since Run began to the elapsed time.
+func (d *Downloader) stopClock() {
+	d.partMu.Lock()
+	defer d.partMu.Unlock()
+	if !d.runStart.IsZero() {
+		d.state.Elapsed += time.Since(d.runStart)
+		d.runStart = time.Time{}
+	}
+}
+
+func (d *Downloader) partStatus(part *Part) (int64, bool) {
+	d.partMu.Lock()
+	defer d.partMu.Unlock()
+	return part.CurrentOffset, part.IsComplete
+}
+
+// Discard removes the session and its part files.
+func (d *Downloader) Discard() {
+	d.store.Delete(d.state.ID)
+	util.CleanupTempFiles(d.state.Filename)
+}
+
+// debug sends a DebugEvent, for the parts of a download that run
+// before or outside of the Downloader.
+func (o Options) debug(msg string) {
+	if o.OnEvent != nil {
+		o.OnEvent(DebugEvent{Message: msg})
+	}
+}
+
+func (d *Downloader) emit(e Event) {
+	if d.opts.OnEvent != nil {
+		d.opts.OnEvent(e)
+	}
+}
+
+// Run drives all workers to completion, then merges the parts. When ctx
+// is cancelled the workers stop, the state is saved and ctx.Err() is
+// returned so the session can be resumed later.
+func (d *Downloader) Run(ctx context.Context) (err error) {
+	state := d.state
+	config := d.opts
+
+	d.runCtx = ctx
+	d.downloadErr = nil
+	d.failed = make(chan struct{})
+	d.parked = nil
+	d.workerCtx = make(map[int]*workerControl)
+	d.tuner = nil
+	if config.AutoWorkers {
+		d.pool = newWorkerPool(d.capWorkers(autoStartWorkers))
+		d.tuner = newTuner(d)
+	} else {
+		d.pool = newWorkerPool(d.capWorkers(config.Workers))
+		if d.hostCap > 0 && d.hostCap < config.Workers {
+			d.emit(WorkersEvent{Workers: d.hostCap, Reason: "host limit, " + d.hostReason})
+		}
+	}
+	d.throttled.Store(0)
+
+	d.partMu.Lock()
+	d.runStart = time.Now()
+	state.LastError = ""
+	state.LinkExpired = false
+	d.partMu.Unlock()
+	defer d.stopClock()
+	defer func() {
+		if err != nil && ctx.Err() == nil {
+			d.recordFailure(err)
+		}
+	}()
+
+	done := make(chan struct{})
+
+	// register every part up front, so the first speed sample does not
+	// count bytes from an earlier run
+	for _, part := range state.Parts {
+		d.tracker.register(part.ID, part.Start, part.End)
+		d.tracker.update(part.ID, part.CurrentOffset)
+	}
+
+	d.emit(StartEvent{ID: state.ID, URL: state.URL, Filename: state.Filename, TotalSize: state.TotalSize, Parts: len(state.Parts)})
+
+	// Speed and state routine
+	go func() {
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+
+		lastBytes := d.tracker.totalReceived()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				d.Save()
+				currentBytes := d.tracker.totalReceived()
+				speed := float64(currentBytes-lastBytes) * 2 // bytes per second (500ms * 2)
+				lastBytes = currentBytes
+				d.dialer.sample(0.5)
+
+				d.partMu.Lock()
+				if speed > state.PeakSpeed {
+					state.PeakSpeed = speed
+				}
+				d.partMu.Unlock()
+				if d.tuner != nil {
+					d.tuner.sample(speed)
+				}
+
+				var timeRemaining int64
+				if speed > 0 {
+					timeRemaining = (state.TotalSize - currentBytes) / int64(speed)
+				}
+				d.emit(SpeedEvent{BytesPerSec: speed, TimeRemaining: time.Duration(timeRemaining) * time.Second, Received: currentBytes})
+
+				if currentBytes >= state.TotalSize {
+					return
+				}
+			}
+		}
+	}()
+
+	// worker performance routine
+	go func() {
+		ticker := time.NewTicker(config.SpeedCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				d.checkAndRestartSlowWorkers()
+			}
+		}
+	}()
+
+	// init the workers, from a copy since finished workers add parts
+	for _, part := range d.parts() {
+		if part.IsComplete {
+			d.tracker.update(part.ID, part.End-part.Start+1)
+			continue
+		}
+
+		// lastbyte is for speed tracking
+		part.LastBytes = part.CurrentOffset
+		part.failures = 0
+		d.startWorker(part)
+	}
+
+	d.wg.Wait()
+	close(done)
+	d.stopClock()
+	d.Save()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if d.downloadErr != nil {
+		d.emit(ErrorEvent{Err: d.downloadErr})
+		return d.downloadErr
+	}
+
+	// merge all
+	algo, h := digestHash(state.Checksum)
+	err = mergeParts(state.Filename, state.Parts, h, d.emit)
+	if err != nil {
+		err = fmt.Errorf("merge failed: %v", err)
+		d.emit(ErrorEvent{Err: err})
+		return err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+
+	if state.Checksum != "" {
+		if err := checkDigest(state.Checksum, digest); err != nil {
+			d.emit(ErrorEvent{Err: err})
+			return err
+		}
+	}
+
+	d.partMu.Lock()
+	state.Completed = time.Now()
+	state.Digest = algo + "=" + digest
+	// downloads shorter than one speed sample never recorded a peak
+	if state.Elapsed > 0 {
+		if avg := float64(state.TotalSize) / state.Elapsed.Seconds(); avg > state.PeakSpeed {
+			state.PeakSpeed = avg
+		}
+	}
+	d.partMu.Unlock()
+	d.Save()
+	d.store.Complete(state)
+	util.CleanupTempFiles(state.Filename)
+
+	d.emit(DoneEvent{})
+	return nil
+}
+
+func (d *Downloader) startWorker(part *Part) {
+	d.spawnMu.Lock()
+	defer d.spawnMu.Unlock()
+	d.spawnLocked(part)
+}
+
+func (d *Downloader) spawnLocked(part *Part) {
+	d.outstanding++
+	d.wg.Add(1)
+	go d.runWorker(part)
+}
+
+func (d *Downloader) workerDone() {
+	d.spawnMu.Lock()
+	defer d.spawnMu.Unlock()
+	d.outstanding--
+	d.wg.Done()
+}
+
+// setWorkers changes how many parts download at once and returns how
+// many workers there are now, which is also the new limit. New slots go
+// to parts waiting for one, or else to pieces split off running parts.
+func (d *Downloader) setWorkers(n int) int {
+	d.pool.setLimit(n)
+
+	d.spawnMu.Lock()
+	defer d.spawnMu.Unlock()
+	// with no workers left Run is done, nothing may start
+	for d.outstanding > 0 && d.outstanding < n {
+		part, _ := d.unpark()
+		if part == nil {
+			part = d.steal()
+		}
+		if part == nil {
+			break
+		}
+		d.spawnLocked(part)
+	}
+	got := min(d.outstanding, n)
+	if got > 0 && got < n {
+		// fewer could start than asked for, keep the limit at what runs
+		// so that a step back is taken from there
+		d.pool.setLimit(got)
+	}
+	return got
+}
+
+// nextPart gives a worker that finished its part more to do: a parked
+// part whose wait is over, or else the back half of the widest part,
+// unless other parts wait for a slot and should get this one. With
+// nothing to split it waits for the parked parts.
+func (d *Downloader) nextPart() *Part {
+	for {
+		select {
+		case <-d.failed:
+			return nil
+		default:
+		}
+		if d.runCtx.Err() != nil {
+			return nil
+		}
+
+		d.spawnMu.Lock()
+		if d.outstanding > d.pool.getLimit() {
+			d.spawnMu.Unlock()
+			return nil
+		}
+		part, wait := d.unpark()
+		if part == nil {
+			part = d.steal()
+		}
+		d.spawnMu.Unlock()
+		if part != nil || wait == 0 {
+			return part
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-d.failed:
+		case <-d.runCtx.Done():
+		}
+	}
+}
+
+// capWorkers keeps n within what the host is known to take.
+func (d *Downloader) capWorkers(n int) int {
+	if d.hostCap > 0 {
+		return min(n, d.hostCap)
+	}
+	return n
+}
+
+// parts copies the part list, which grows while workers run.
+func (d *Downloader) parts() []*Part {
+	d.partMu.Lock()
+	defer d.partMu.Unlock()
+	return append([]*Part(nil), d.state.Parts...)
+}
+
+func (d *Downloader) newWorkerControl(part *Part) *workerControl {
+	ctx, cancel := context.WithCancel(d.runCtx)
+	ctrl := &workerControl{ctx: ctx, cancel: cancel}
+	d.ctxMu.Lock()
+	d.workerCtx[part.ID] = ctrl
+	d.ctxMu.Unlock()
+	return ctrl
+}
+
+// runWorker downloads part on one goroutine once the pool has a slot
+// for it, then keeps the slot for parked parts and parts it splits off
+// others.
+func (d *Downloader) runWorker(part *Part) {
+	defer d.workerDone()
+
+	if !d.pool.acquire(d.runCtx) {
+		return
+	}
+	defer d.pool.release()
+
+	for part != nil {
+		err := d.attempt(part)
+		if errors.Is(err, ErrWorkerCancelled) {
+			return
+		}
+		if err != nil {
+			d.park(part, err)
+		} else {
+			d.markComplete(part)
+			d.emit(PartEvent{Kind: PartCompleted, ID: part.ID, Start: part.Start, End: d.partEnd(part)})
+		}
+		part = d.nextPart()
+	}
+}
+
+const (
+	// maxPartFailures is how often a part may use up its retries before
+	// the download gives up on it. It is fixed, not counted per address
+	// or link: the dialer already moves on from addresses it can't
+	// reach, so a part failing this often fails on every way to the
+	// server, and the waits in between give it at least half a minute.
+	maxPartFailures = 5
+	// parkBackoff is how long a failed part waits before it is tried
+	// again, doubled with every failure up to maxParkBackoff.
+	parkBackoff    = 2 * time.Second
+	maxParkBackoff = 30 * time.Second
+)
+
+// park puts a part that used up its retries aside. The other workers
+// carry on and split it up while it waits, then one of them takes it
+// up again. An expired link, or a part that keeps failing, ends the
+// download once the running parts are done.
+func (d *Downloader) park(part *Part, err error) {
+	offset, _ := d.partStatus(part)
+
+	d.spawnMu.Lock()
+	part.failures++
+	failures := part.failures
+	fatal := errors.Is(err, ErrLinkExpired) || failures >= maxPartFailures
+	wait := min(parkBackoff<<(failures-1), maxParkBackoff)
+	if !fatal {
+		part.retryAt = time.Now().Add(wait)
+		d.parked = append(d.parked, part)
+	}
+	d.spawnMu.Unlock()
+
+	if fatal {
+		d.emit(PartEvent{Kind: PartFailed, ID: part.ID, Offset: offset, Attempt: failures, Err: err})
+		d.fail(err)
+		return
+	}
+	d.emit(PartEvent{Kind: PartParked, ID: part.ID, Offset: offset, Attempt: failures, RetryIn: wait, Err: err})
+	d.emit(DebugEvent{Message: fmt.Sprintf("Parking worker %d for %s: %v [failure %d/%d]", part.ID, wait, err, failures, maxPartFailures)})
+}
+
+// fail stops handing out parts and has Run return err. An expired link
+// wins over other errors, it tells the user what to do.
+func (d *Downloader) fail(err error) {
+	d.errMu.Lock()
+	defer d.errMu.Unlock()
+	if d.downloadErr == nil {
+		close(d.failed)
+	}
+	if d.downloadErr == nil || errors.Is(err, ErrLinkExpired) {
+		d.downloadErr = err
+	}
+}
+
+// unpark takes the parked part that has waited longest, once its time
+// is up. Otherwise it returns how long until the next one is, 0 if no
+// part is parked. spawnMu must be held.
+func (d *Downloader) unpark() (*Part, time.Duration) {
+	var wait time.Duration
+	for i, part := range d.parked {
+		left := time.Until(part.retryAt)
+		if left <= 0 {
+			d.parked = append(d.parked[:i], d.parked[i+1:]...)
+			return part, 0
+		}
+		if wait == 0 || left < wait {
+			wait = left
+		}
+	}
+	return nil, wait
+}
+
+// maxThrottles is how often a part waits out a 429 or 503 before the
+// download fails.
+const maxThrottles = 10
+
+// attempt downloads part until it is done. A restart cancels the
+// current try and starts over here, so two connections never write the
+// same part file. A throttling server costs the pool a slot and this
+// worker a wait.
+func (d *Downloader) attempt(part *Part) error {
+	throttles := 0
+	for {
+		ctrl := d.newWorkerControl(part)
+		err := d.tryDownload(ctrl.ctx, part)
+		ctrl.cancel()
+		d.ctxMu.Lock()
+		delete(d.workerCtx, part.ID)
+		d.ctxMu.Unlock()
+
+		if d.runCtx.Err() != nil {
+			return ErrWorkerCancelled
+		}
+		if errors.Is(err, ErrWorkerCancelled) && ctrl.restart.Load() {
+			continue
+		}
+		if errors.Is(err, errYield) {
+			if !d.pool.yield(d.runCtx) {
+				return ErrWorkerCancelled
+			}
+			continue
+		}
+
+		var throttled *throttledError
+		if !errors.As(err, &throttled) || throttles >= maxThrottles {
+			return err
+		}
+		throttles++
+		if d.tuner != nil {
+			d.tuner.throttled()
+		}
+		offset, _ := d.partStatus(part)
+		d.emit(PartEvent{Kind: PartRetried, ID: part.ID, Offset: offset, Attempt: throttles, Err: err})
+		if workers, lowered := d.pool.lower(); lowered {
+			d.emit(WorkersEvent{Workers: workers, Reason: throttled.status})
+		}
+		d.learnLimit(d.pool.getLimit(), throttled.status)
+
+		wait := throttled.retryAfter
+		if wait == 0 {
+			wait = time.Duration(throttles) * time.Second
+		}
+		select {
+		case <-time.After(wait):
+		case <-d.runCtx.Done():
+			return ErrWorkerCancelled
+		}
+		if !d.pool.yield(d.runCtx) {
+			return ErrWorkerCancelled
+		}
+	}
+}
+
+func (d *Downloader) checkAndRestartSlowWorkers() {
+	config := d.opts
+
+	var speeds []float64
+	var totalSpeed float64
+	var activeWorkers []*Part
+
+	for _, part := range d.parts() {
+		if _, complete := d.partStatus(part); complete {
+			continue
+		}
+		// parts waiting for a free worker have no speed to judge
+		d.ctxMu.RLock()
+		_, started := d.workerCtx[part.ID]
+		d.ctxMu.RUnlock()
+		if !started {
+			continue
+		}
+
+		received := d.tracker.received(part.ID)
+		speed := float64(received-part.LastBytes) / config.SpeedCheckInterval.Seconds()
+		part.LastBytes = received
+
+		if speed >= 0 {
+			speeds = append(speeds, speed)
+			totalSpeed += speed
+			activeWorkers = append(activeWorkers, part)
+		}
+	}
+
+	if len(activeWorkers) == 0 {
+		return
+	}
+
+	meanSpeed := totalSpeed / float64(len(activeWorkers))
+
+	// we only restart if mean speed is above threshold
+	if meanSpeed < config.MinMeanSpeedForRestart {
+		return
+	}
+
+	threshold := meanSpeed * config.SlowWorkerThreshold
+
+	d.emit(DebugEvent{Message: fmt.Sprintf("Speed check: mean=%.1f KB/s, threshold=%.1f KB/s", meanSpeed/1024, threshold/1024)})
+
+	for i, part := range activeWorkers {
+		if speeds[i] < threshold && part.Restarts < config.MaxWorkerRestarts {
+			// cancel and restart this worker
+			d.ctxMu.RLock()
+			ctrl := d.workerCtx[part.ID]
+			d.ctxMu.RUnlock()
+
+			part.Restarts++
+			d.partMu.Lock()
+			part.RestartCount++
+			d.partMu.Unlock()
+			offset, _ := d.partStatus(part)
+			d.emit(PartEvent{Kind: PartRestarted, ID: part.ID, Offset: offset, Attempt: part.Restarts})
+
+			d.emit(DebugEvent{Message: fmt.Sprintf("Restarting worker %d (%.1f KB/s < %.1f KB/s) [restart %d/%d]", part.ID, speeds[i]/1024, threshold/1024, part.Restarts, config.MaxWorkerRestarts)})
+
+			d.partMu.Lock()
+			conn := part.conn
+			d.partMu.Unlock()
+			if conn != nil {
+				d.dialer.slow(conn)
+			}
+
+			if ctrl != nil {
+				ctrl.restart.Store(true)
+				ctrl.cancel()
+			}
+		}
+	}
+}
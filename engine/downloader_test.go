@@ -0,0 +1,670 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fileServer serves data with range requests. The fields change how it
+// answers, tests set them before the download starts.
+type fileServer struct {
+	data []byte
+	// pace is the pause after every 64 KiB of the range starting at
+	// start, none if nil
+	pace func(start int64) time.Duration
+	// answer sees every request for more than the probe's first byte
+	// and reports whether it answered it itself
+	answer func(w http.ResponseWriter, r *http.Request, start, end int64) bool
+	// maxConns is how many ranges it sends at once, the ones beyond
+	// get busyStatus, or have their connection reset if it is 0. 0
+	// maxConns is no limit.
+	maxConns   int
+	busyStatus int
+
+	mu     sync.Mutex
+	ranges [][2]int64
+	active int
+	// remotes are the client ends of the connections asked over
+	remotes map[string]bool
+}
+
+// newFileServer serves size bytes of random data.
+func newFileServer(t *testing.T, size int) (*fileServer, *httptest.Server) {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	s := &fileServer{data: data}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start, end := int64(0), int64(len(s.data))-1
+	ranged := false
+	if v := r.Header.Get("Range"); v != "" {
+		from, to, _ := strings.Cut(strings.TrimPrefix(v, "bytes="), "-")
+		start, _ = strconv.ParseInt(from, 10, 64)
+		if to != "" {
+			end, _ = strconv.ParseInt(to, 10, 64)
+		}
+		ranged = true
+	}
+
+	s.mu.Lock()
+	s.ranges = append(s.ranges, [2]int64{start, end})
+	if s.remotes == nil {
+		s.remotes = make(map[string]bool)
+	}
+	s.remotes[r.RemoteAddr] = true
+	busy := ranged && end > 0 && s.maxConns > 0 && s.active >= s.maxConns
+	if !busy {
+		s.active++
+	}
+	pace := s.pace
+	s.mu.Unlock()
+	if busy && s.busyStatus == 0 {
+		resetConn(w)
+		return
+	}
+	if busy {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(s.busyStatus)
+		return
+	}
+	defer func() {
+		s.mu.Lock()
+		s.active--
+		s.mu.Unlock()
+	}()
+
+	if end > 0 && s.answer != nil && s.answer(w, r, start, end) {
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	if ranged {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(s.data)))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	for at := start; at <= end; at += 64 << 10 {
+		if _, err := w.Write(s.data[at:min(at+64<<10, end+1)]); err != nil {
+			return
+		}
+		if pace != nil {
+			w.(http.Flusher).Flush()
+			time.Sleep(pace(start))
+		}
+	}
+}
+
+// resetConn drops the connection of w with a TCP reset.
+func resetConn(w http.ResponseWriter) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+func (s *fileServer) setPace(pace func(start int64) time.Duration) {
+	s.mu.Lock()
+	s.pace = pace
+	s.mu.Unlock()
+}
+
+// requested are the ranges asked for so far, without the probe.
+func (s *fileServer) requested() [][2]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ranges [][2]int64
+	for _, r := range s.ranges {
+		if r[1] > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+// connections is how many connections requests came over, the probe's
+// included.
+func (s *fileServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.remotes)
+}
+
+// recorder keeps the events of a download for the test to look at.
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *recorder) add(e Event) {
+	r.mu.Lock()
+	r.events = append(r.events, e)
+	r.mu.Unlock()
+}
+
+func (r *recorder) parts(kind PartEventKind) []PartEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var parts []PartEvent
+	for _, e := range r.events {
+		if p, ok := e.(PartEvent); ok && p.Kind == kind {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+func (r *recorder) workers() []WorkersEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var workers []WorkersEvent
+	for _, e := range r.events {
+		if w, ok := e.(WorkersEvent); ok {
+			workers = append(workers, w)
+		}
+	}
+	return workers
+}
+
+func (r *recorder) debug() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var messages []string
+	for _, e := range r.events {
+		if d, ok := e.(DebugEvent); ok {
+			messages = append(messages, d.Message)
+		}
+	}
+	return messages
+}
+
+func newTestStore(t *testing.T) *FileStore {
+	dir := t.TempDir()
+	s := &FileStore{
+		OngoingDir:  filepath.Join(dir, "ongoing"),
+		CompleteDir: filepath.Join(dir, "complete"),
+		HostsFile:   filepath.Join(dir, "hosts.json"),
+	}
+	for _, d := range []string{s.OngoingDir, s.CompleteDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func testOptions(t *testing.T, rec *recorder) Options {
+	opts := DefaultOptions()
+	opts.Store = newTestStore(t)
+	opts.OnEvent = rec.add
+	return opts
+}
+
+// download runs a new download of url to a temporary file.
+func download(t *testing.T, url string, opts Options) (*Downloader, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	d, err := New(ctx, url, filepath.Join(t.TempDir(), "file.bin"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	return d, d.Run(ctx)
+}
+
+func checkFile(t *testing.T, path string, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s differs from the served file: %d bytes, want %d", path, len(got), len(want))
+	}
+	if parts, _ := filepath.Glob(path + ".part_*"); len(parts) > 0 {
+		t.Errorf("part files left behind: %v", parts)
+	}
+}
+
+func TestDownloadSplitsAndMerges(t *testing.T) {
+	// not a multiple of the block size, the last part ends off it
+	size := 5<<20 + 123
+	s, srv := newFileServer(t, size)
+	rec := &recorder{}
+	opts := testOptions(t, rec)
+	opts.Workers = 4
+
+	d, err := download(t, srv.URL+"/file.bin", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, d.State().Filename, s.data)
+
+	parts := d.State().Parts
+	if len(parts) != 4 {
+		t.Fatalf("got %d parts, want 4", len(parts))
+	}
+	next := int64(0)
+	for _, p := range parts {
+		if p.Start != next {
+			t.Errorf("part %d starts at %d, want %d", p.ID, p.Start, next)
+		}
+		if p.Start%defaultBlockSize != 0 {
+			t.Errorf("part %d starts at %d, off the block size", p.ID, p.Start)
+		}
+		next = p.End + 1
+	}
+	if next != int64(size) {
+		t.Errorf("parts end at %d, want %d", next, size)
+	}
+	if got := len(s.requested()); got != 4 {
+		t.Errorf("server got %d range requests, want 4", got)
+	}
+	completed, _ := opts.Store.List(true)
+	if len(completed) != 1 {
+		t.Errorf("%d completed sessions, want 1", len(completed))
+	}
+}
+
+func TestThrottlingServerGetsFewerWorkers(t *testing.T) {
+	// 0 has the server reset the connections over its limit
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable, 0} {
+		t.Run(strconv.Itoa(status), func(t *testing.T) {
+			s, srv := newFileServer(t, 4<<20)
+			s.maxConns, s.busyStatus = 2, status
+			s.pace = func(int64) time.Duration { return 10 * time.Millisecond }
+			rec := &recorder{}
+			opts := testOptions(t, rec)
+			opts.Workers = 4
+
+			d, err := download(t, srv.URL+"/file.bin", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFile(t, d.State().Filename, s.data)
+
+			workers := rec.workers()
+			if len(workers) == 0 {
+				t.Fatal("no workers event")
+			}
+			reason := fmt.Sprintf("%d %s", status, http.StatusText(status))
+			if status == 0 {
+				reason = "connection reset"
+			}
+			for _, w := range workers {
+				if w.Workers >= 4 || w.Reason != reason {
+					t.Errorf("workers event %+v, want fewer than 4 for %q", w, reason)
+				}
+			}
+			for _, p := range rec.parts(PartRetried) {
+				var throttled *throttledError
+				if !errors.As(p.Err, &throttled) {
+					t.Errorf("part %d retried for %v, want throttling", p.ID, p.Err)
+				}
+			}
+		})
+	}
+}
+
+func TestHostLimitNeedsEvidenceAndExpires(t *testing.T) {
+	opts := testOptions(t, &recorder{})
+	state := &DownloadState{URL: "http://example.com/file.bin"}
+	d := newDownloader(state, opts, nil, nil)
+	profiles := opts.Store.(HostProfiles)
+
+	for i := 1; i < minThrottleEvidence; i++ {
+		d.learnLimit(2, "429 Too Many Requests")
+		if _, ok := profiles.HostProfile("example.com"); ok {
+			t.Fatalf("limit saved after %d throttles", i)
+		}
+	}
+	d.learnLimit(2, "429 Too Many Requests")
+	if n, reason := hostLimit(state, opts); n != 2 || !strings.Contains(reason, "example.com gave 429") {
+		t.Errorf("hostLimit = %d, %q, want 2 from example.com", n, reason)
+	}
+
+	old := HostProfile{MaxConnections: 2, Learned: time.Now().Add(-hostLimitTTL - time.Hour)}
+	if err := profiles.SetHostProfile("example.com", old); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := hostLimit(state, opts); n != 0 {
+		t.Errorf("expired limit still used: %d", n)
+	}
+
+	opts.MaxConnPerHost = 3
+	if n, reason := hostLimit(state, opts); n != 3 || reason != "--max-conn-per-host" {
+		t.Errorf("hostLimit = %d, %q, want the one set by hand", n, reason)
+	}
+}
+
+func TestStalledConnectionIsRetried(t *testing.T) {
+	s, srv := newFileServer(t, 2<<20)
+	half := int64(len(s.data) / 2)
+	var stalled atomic.Bool
+	s.answer = func(w http.ResponseWriter, r *http.Request, start, end int64) bool {
+		if stalled.Swap(true) {
+			return false
+		}
+		// send half of it, then go quiet
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(s.data)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(s.data[start:half])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		return true
+	}
+	rec := &recorder{}
+	opts := testOptions(t, rec)
+	opts.Workers = 1
+	opts.IdleTimeout = 200 * time.Millisecond
+	// a stall after progress does not use up a retry
+	opts.MaxRetries = 1
+
+	d, err := download(t, srv.URL+"/file.bin", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, d.State().Filename, s.data)
+
+	retried := rec.parts(PartRetried)
+	if len(retried) != 1 || !errors.Is(retried[0].Err, errStalled) {
+		t.Fatalf("retries %+v, want one for the stall", retried)
+	}
+	ranges := s.requested()
+	if len(ranges) != 2 || ranges[1][0] <= 0 || ranges[1][0] > half {
+		t.Errorf("requested %v, want the retry to pick up after what arrived", ranges)
+	}
+}
+
+func TestStallWithoutRangeSupportStartsOver(t *testing.T) {
+	data := make([]byte, 2<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	var stalled atomic.Bool
+	var mu sync.Mutex
+	var ranges []string
+	// a server that always sends the whole file with a 200
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probe := r.Header.Get("Range") == "bytes=0-0"
+		if !probe {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if !probe && !stalled.Swap(true) {
+			w.Write(data[:len(data)/2])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+
+	rec := &recorder{}
+	opts := testOptions(t, rec)
+	opts.IdleTimeout = 200 * time.Millisecond
+
+	d, err := download(t, srv.URL+"/file.bin", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, d.State().Filename, data)
+	if len(rec.parts(PartRetried)) != 1 {
+		t.Errorf("retries %+v, want one for the stall", rec.parts(PartRetried))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ranges) != 2 || ranges[0] != "" || ranges[1] != "" {
+		t.Errorf("ranges asked for %q, want the whole file twice", ranges)
+	}
+}
+
+// interrupted runs a download of url with one worker and cancels it
+// once some of it is on disk. The session is left to resume.
+func interrupted(t *testing.T, s *fileServer, url string, opts Options) *DownloadState {
+	t.Helper()
+	s.setPace(func(int64) time.Duration { return 20 * time.Millisecond })
+	defer s.setPace(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	onEvent := opts.OnEvent
+	opts.OnEvent = func(e Event) {
+		if sp, ok := e.(SpeedEvent); ok && sp.Received >= 1<<20 {
+			cancel()
+		}
+		onEvent(e)
+	}
+	d, err := New(ctx, url, filepath.Join(t.TempDir(), "file.bin"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Run(ctx)
+	d.Close()
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run = %v, want it cancelled", err)
+	}
+	state, err := FindSession(opts.Store, d.State().ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func resume(t *testing.T, state *DownloadState, opts Options) (*Downloader, error) {
+	t.Helper()
+	d, err := Resume(state, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return d, d.Run(ctx)
+}
+
+func TestResumeSplitsWhatIsLeft(t *testing.T) {
+	s, srv := newFileServer(t, 4<<20)
+	rec := &recorder{}
+	opts := testOptions(t, rec)
+	opts.Workers = 1
+	opts.MinPartSize = 256 << 10
+
+	state := interrupted(t, s, srv.URL+"/file.bin", opts)
+	if len(state.Parts) != 1 || state.Parts[0].CurrentOffset == 0 {
+		t.Fatalf("interrupted session has parts %+v, want one with progress", state.Parts[0])
+	}
+	done := state.Parts[0].CurrentOffset
+	before := len(s.requested())
+
+	opts.Workers = 4
+	d, err := resume(t, state, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, d.State().Filename, s.data)
+
+	if len(rec.parts(PartStarted)) < 1+4 {
+		t.Errorf("%d parts started after the resume, want 4", len(rec.parts(PartStarted))-1)
+	}
+	first := d.State().Parts[0]
+	if first.Start != 0 || first.End >= int64(len(s.data))-1 {
+		t.Errorf("first part is %d-%d, want it cut short", first.Start, first.End)
+	}
+	for _, r := range s.requested()[before:] {
+		if r[0] < done {
+			t.Errorf("resume asked for %d-%d again, %d bytes were on disk", r[0], r[1], done)
+		}
+	}
+}
+
+func TestIdleWorkerTakesOverSlowPart(t *testing.T) {
+	s, srv := newFileServer(t, 4<<20)
+	// the front of the file comes slowly, the rest at once
+	s.pace = func(start int64) time.Duration {
+		if start == 0 {
+			return 30 * time.Millisecond
+		}
+		return 0
+	}
+	rec := &recorder{}
+	opts := testOptions(t, rec)
+	opts.Workers = 2
+	opts.MinPartSize = 256 << 10
+
+	d, err := download(t, srv.URL+"/file.bin", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, d.State().Filename, s.data)
+
+	parts := d.State().Parts
+	if len(parts) <= 2 {
+		t.Fatalf("got %d parts, want the slow one split", len(parts))
+	}
+	if parts[0].End >= 2<<20-1 {
+		t.Errorf("slow part still ends at %d", parts[0].End)
+	}
+	stolen := false
+	for _, p := range rec.parts(PartStarted) {
+		if p.ID >= 2 && p.Start < 2<<20 {
+			stolen = true
+		}
+	}
+	if !stolen {
+		t.Error("no part was taken from the slow one")
+	}
+}
+
+func TestFailedPartIsParkedAndRetried(t *testing.T) {
+	s, srv := newFileServer(t, 2<<20)
+	var failed atomic.Bool
+	s.answer = func(w http.ResponseWriter, r *http.Request, start, end int64) bool {
+		if start != 0 || failed.Swap(true) {
+			return false
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+	rec := &recorder{}
+	opts := testOptions(t, rec)
+	opts.Workers = 2
+	opts.MaxRetries = 1
+
+	d, err := download(t, srv.URL+"/file.bin", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, d.State().Filename, s.data)
+
+	parked := rec.parts(PartParked)
+	if len(parked) != 1 || parked[0].ID != 0 || parked[0].RetryIn != parkBackoff {
+		t.Fatalf("parked %+v, want part 0 once for %s", parked, parkBackoff)
+	}
+	if failed := rec.parts(PartFailed); len(failed) > 0 {
+		t.Errorf("parts failed: %+v", failed)
+	}
+}
+
+func TestParkBackoffAndGivingUp(t *testing.T) {
+	rec := &recorder{}
+	d := newDownloader(&DownloadState{}, testOptions(t, rec), nil, nil)
+	d.failed = make(chan struct{})
+	part := &Part{ID: 3}
+	cause := errors.New("connection refused")
+
+	for i := 1; i < maxPartFailures; i++ {
+		d.park(part, cause)
+		if len(d.parked) != 1 {
+			t.Fatalf("failure %d: %d parts parked, want 1", i, len(d.parked))
+		}
+		d.parked = nil
+	}
+	d.park(part, cause)
+
+	var waits []time.Duration
+	for _, p := range rec.parts(PartParked) {
+		waits = append(waits, p.RetryIn)
+	}
+	want := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second}
+	if fmt.Sprint(waits) != fmt.Sprint(want) {
+		t.Errorf("waits %v, want %v", waits, want)
+	}
+	if len(d.parked) != 0 || len(rec.parts(PartFailed)) != 1 {
+		t.Errorf("part not given up after %d failures", maxPartFailures)
+	}
+	select {
+	case <-d.failed:
+	default:
+		t.Fatal("download not failed")
+	}
+	if d.downloadErr != cause {
+		t.Errorf("download error %v, want %v", d.downloadErr, cause)
+	}
+}
+
+func TestExpiredLinkEndsDownload(t *testing.T) {
+	s, srv := newFileServer(t, 2<<20)
+	s.answer = func(w http.ResponseWriter, r *http.Request, start, end int64) bool {
+		w.WriteHeader(http.StatusForbidden)
+		return true
+	}
+	rec := &recorder{}
+	d, err := download(t, srv.URL+"/file.bin", testOptions(t, rec))
+	if !errors.Is(err, ErrLinkExpired) {
+		t.Fatalf("Run = %v, want ErrLinkExpired", err)
+	}
+	if !d.State().LinkExpired || len(rec.parts(PartParked)) > 0 {
+		t.Errorf("link expired %v with %d parts parked", d.State().LinkExpired, len(rec.parts(PartParked)))
+	}
+}
+
+func TestResumeDropsUnsyncedBytes(t *testing.T) {
+	s, srv := newFileServer(t, 4<<20)
+	opts := testOptions(t, &recorder{})
+	opts.Workers = 2
+	state := interrupted(t, s, srv.URL+"/file.bin", opts)
+
+	// a crash leaves bytes past the saved offsets: written, never
+	// synced, and maybe more than the part has now
+	state.Parts[1].CurrentOffset = 0
+	if err := opts.Store.Save(state); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range state.Parts {
+		f, err := os.OpenFile(partFileName(state.Filename, p.ID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(bytes.Repeat([]byte{0xff}, int(p.End-p.Start+1)))
+		f.Close()
+	}
+
+	d, err := resume(t, state, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, d.State().Filename, s.data)
+}
@@ -0,0 +1,90 @@
+package engine
+
+import "time"
+
+// Event is anything the engine reports through Options.OnEvent.
+type Event interface {
+	event()
+}
+
+// ProbeEvent reports what the server told us before the split.
+type ProbeEvent struct {
+	URL          string
+	TotalSize    int64
+	RangeSupport bool
+	// Protocol is what the probe was answered with, e.g. "HTTP/1.1"
+	Protocol string
+}
+
+// StartEvent is sent once when Run begins.
+type StartEvent struct {
+	ID        string
+	URL       string
+	Filename  string
+	TotalSize int64
+	Parts     int
+}
+
+type PartEventKind string
+
+const (
+	PartStarted   PartEventKind = "part_started"
+	PartRetried   PartEventKind = "part_retried"
+	PartRestarted PartEventKind = "part_restarted"
+	PartCompleted PartEventKind = "part_completed"
+	// PartParked is sent when a part used up its retries and is put
+	// aside for RetryIn, PartFailed when the download gives up on it.
+	PartParked PartEventKind = "part_parked"
+	PartFailed PartEventKind = "part_failed"
+)
+
+type PartEvent struct {
+	Kind    PartEventKind
+	ID      int
+	Start   int64
+	End     int64
+	Offset  int64
+	Attempt int
+	RetryIn time.Duration
+	Err     error
+}
+
+// SpeedEvent is sampled every 500ms while workers run.
+type SpeedEvent struct {
+	BytesPerSec   float64
+	TimeRemaining time.Duration
+	Received      int64
+}
+
+// MergeEvent is sent after each part file is appended to the output.
+type MergeEvent struct {
+	Part  int
+	Total int
+}
+
+// WorkersEvent is sent when AutoWorkers or a throttling server change
+// how many parts download at once.
+type WorkersEvent struct {
+	Workers int
+	Reason  string
+}
+
+type DebugEvent struct {
+	Message string
+}
+
+type DoneEvent struct{}
+
+type ErrorEvent struct {
+	Err error
+}
+
+func (ProbeEvent) event()   {}
+func (StartEvent) event()   {}
+func (PartEvent) event()    {}
+func (SpeedEvent) event()   {}
+func (MergeEvent) event()   {}
+func (WorkersEvent) event() {}
+func (DebugEvent) event()   {}
+func (DoneEvent) event()    {}
+func (ErrorEvent) event()   {}
@@ -0,0 +1,145 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// HostProfile is what a server taught us about itself.
+type HostProfile struct {
+	// MaxConnections is how many connections it put up with before it
+	// started to answer 429 or 503 or reset them.
+	MaxConnections int       `json:"max_connections"`
+	Reason         string    `json:"reason,omitempty"`
+	Learned        time.Time `json:"learned"`
+}
+
+// HostProfiles is implemented by stores that remember per host limits.
+// New downloads from a host with a profile start at its limit.
+type HostProfiles interface {
+	HostProfile(host string) (HostProfile, bool)
+	SetHostProfile(host string, p HostProfile) error
+}
+
+const (
+	// hostLimitTTL is how long a learned limit is used. Servers change
+	// and a limit learned on a bad day should not stick.
+	hostLimitTTL = 7 * 24 * time.Hour
+	// minThrottleEvidence is how many times the server has to push back
+	// in one download before its limit is remembered, one busy moment
+	// says little about the server
+	minThrottleEvidence = 3
+)
+
+// hostsMu keeps the read, change, write of the hosts file in order
+// within a process, parallel downloads learn limits at the same time.
+var hostsMu sync.Mutex
+
+func (s *FileStore) readHosts() (map[string]HostProfile, error) {
+	hosts := make(map[string]HostProfile)
+	data, err := os.ReadFile(s.HostsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return hosts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &hosts); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+func (s *FileStore) HostProfile(host string) (HostProfile, bool) {
+	if s.HostsFile == "" {
+		return HostProfile{}, false
+	}
+	hostsMu.Lock()
+	defer hostsMu.Unlock()
+	hosts, err := s.readHosts()
+	if err != nil {
+		return HostProfile{}, false
+	}
+	p, ok := hosts[host]
+	return p, ok
+}
+
+func (s *FileStore) SetHostProfile(host string, p HostProfile) error {
+	if s.HostsFile == "" {
+		return nil
+	}
+	hostsMu.Lock()
+	defer hostsMu.Unlock()
+	hosts, err := s.readHosts()
+	if err != nil {
+		// a broken file only costs what was learned so far
+		hosts = make(map[string]HostProfile)
+	}
+	hosts[host] = p
+	data, err := json.MarshalIndent(hosts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.HostsFile, data)
+}
+
+// limitHost is the host a download's connections go to: the one the
+// probe ended up at after redirects, as host:port.
+func limitHost(state *DownloadState) string {
+	raw := state.URL
+	if state.Server != nil && state.Server.FinalURL != "" {
+		raw = state.Server.FinalURL
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// hostLimit is the most connections the download may open to its host:
+// MaxConnPerHost if set, else the limit learned lately, 0 for none. The
+// reason says where it comes from.
+func hostLimit(state *DownloadState, opts Options) (int, string) {
+	if opts.MaxConnPerHost > 0 {
+		return opts.MaxConnPerHost, "--max-conn-per-host"
+	}
+	profiles, ok := opts.Store.(HostProfiles)
+	if !ok {
+		return 0, ""
+	}
+	host := limitHost(state)
+	p, ok := profiles.HostProfile(host)
+	if !ok || time.Since(p.Learned) > hostLimitTTL {
+		return 0, ""
+	}
+	return p.MaxConnections, fmt.Sprintf("%s gave %s on %s", host, p.Reason, p.Learned.Format("Jan 2"))
+}
+
+// learnLimit records that the host wanted no more than n connections,
+// once it has pushed back often enough in this download, unless a
+// recent limit is lower already.
+func (d *Downloader) learnLimit(n int, reason string) {
+	if d.throttled.Add(1) < minThrottleEvidence {
+		return
+	}
+	profiles, ok := d.store.(HostProfiles)
+	if !ok {
+		return
+	}
+	host := limitHost(d.state)
+	if p, ok := profiles.HostProfile(host); ok && p.MaxConnections <= n && time.Since(p.Learned) <= hostLimitTTL {
+		return
+	}
+	err := profiles.SetHostProfile(host, HostProfile{MaxConnections: n, Reason: reason, Learned: time.Now()})
+	if err != nil {
+		d.emit(DebugEvent{Message: fmt.Sprintf("Could not save the limit of %s: %v", host, err)})
+		return
+	}
+	d.emit(DebugEvent{Message: fmt.Sprintf("Remembering at most %d connections for %s", n, host)})
+}
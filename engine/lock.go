@@ -0,0 +1,160 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var ErrSessionLocked = errors.New("session is in use")
+
+// staleEmptyLock is how old a lock file without readable content must
+// be before it is taken over. A fresh one may still be being written.
+const staleEmptyLock = 10 * time.Second
+
+// pidReuseSlack allows for the coarse process start times of the
+// system and for clock adjustments since the lock was taken.
+const pidReuseSlack = 10 * time.Second
+
+// LockInfo says which process holds a session.
+type LockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+}
+
+// LockedError is returned when another process holds the session.
+type LockedError struct {
+	ID   string
+	Info LockInfo
+}
+
+func (e *LockedError) Error() string {
+	if e.Info.PID == 0 {
+		// the lock file is still being written
+		return fmt.Sprintf("session %s is being started by another process", e.ID)
+	}
+	return fmt.Sprintf("session %s is in use by pid %d on %s since %s",
+		e.ID, e.Info.PID, e.Info.Host, e.Info.Started.Local().Format("15:04:05 Jan 2"))
+}
+
+func (e *LockedError) Is(target error) bool {
+	return target == ErrSessionLocked
+}
+
+// Locker is implemented by stores that can keep two processes from
+// running the same session. The lock is advisory, it only works
+// between programs that ask for it.
+type Locker interface {
+	// Lock takes the session for this process, unlock gives it back.
+	Lock(id string) (unlock func(), err error)
+	// Holder reports the live process holding id, if there is one.
+	Holder(id string) (*LockInfo, bool)
+}
+
+func (s *FileStore) lockPath(id string) string {
+	return s.path(s.OngoingDir, id) + ".lock"
+}
+
+func (s *FileStore) Lock(id string) (func(), error) {
+	path := s.lockPath(id)
+	host, _ := os.Hostname()
+	data, err := json.Marshal(LockInfo{PID: os.Getpid(), Host: host, Started: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.OngoingDir, 0755); err != nil {
+		return nil, err
+	}
+
+	// a stale lock is removed once and then we try again
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, werr := f.Write(data)
+			f.Close()
+			if werr != nil {
+				os.Remove(path)
+				return nil, werr
+			}
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+
+		if info, held := s.Holder(id); held {
+			return nil, &LockedError{ID: id, Info: *info}
+		}
+		if _, err := s.ClearStaleLock(id); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w: could not take the lock for %s", ErrSessionLocked, id)
+}
+
+// ClearStaleLock removes the lock of id if its holder is gone and
+// reports whether it did. Two processes can find the same lock stale,
+// and the one that comes second must not remove the lock the first has
+// taken in the meantime. So the removal happens under a second lock
+// file, after looking at the holder again.
+func (s *FileStore) ClearStaleLock(id string) (bool, error) {
+	path := s.lockPath(id)
+	guard := path + ".takeover"
+	f, err := os.OpenFile(guard, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		if !errors.Is(err, os.ErrExist) {
+			return false, err
+		}
+		// someone else is at it, or crashed while at it
+		if st, err := os.Stat(guard); err == nil && time.Since(st.ModTime()) > staleEmptyLock {
+			os.Remove(guard)
+		}
+		return false, nil
+	}
+	f.Close()
+	defer os.Remove(guard)
+
+	if _, held := s.Holder(id); held {
+		return false, nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *FileStore) Holder(id string) (*LockInfo, bool) {
+	path := s.lockPath(id)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	var info LockInfo
+	if err := json.Unmarshal(data, &info); err != nil || info.PID == 0 {
+		// the holder may still be writing it, give it some time
+		st, err := os.Stat(path)
+		if err == nil && time.Since(st.ModTime()) < staleEmptyLock {
+			return &LockInfo{Started: st.ModTime()}, true
+		}
+		return nil, false
+	}
+
+	// we can only check processes on this machine, a lock from another
+	// host (shared home directory) is trusted
+	host, _ := os.Hostname()
+	if info.Host == host {
+		if !processAlive(info.PID) {
+			return nil, false
+		}
+		// a process that started after the lock was taken got the pid
+		// of the holder after it died
+		if started, ok := processStarted(info.PID); ok && started.After(info.Started.Add(pidReuseSlack)) {
+			return nil, false
+		}
+	}
+	return &info, true
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !windows
+
+package engine
+
+import "time"
+
+// processStarted reports when pid started. Without /proc there is no
+// portable way to ask, so a reused pid is taken for the holder.
+func processStarted(pid int) (time.Time, bool) {
+	return time.Time{}, false
+}
@@ -0,0 +1,159 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeLock leaves a lock for id as another process would.
+func writeLock(t *testing.T, s *FileStore, id string, info LockInfo) {
+	t.Helper()
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.lockPath(id), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockRefusesLiveHolder(t *testing.T) {
+	s := newTestStore(t)
+	unlock, err := s.Lock("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, held := s.Holder("abc")
+	if !held || info.PID != os.Getpid() {
+		t.Fatalf("holder %+v, %v, want this process", info, held)
+	}
+
+	_, err = s.Lock("abc")
+	var locked *LockedError
+	if !errors.As(err, &locked) || !errors.Is(err, ErrSessionLocked) || locked.Info.PID != os.Getpid() {
+		t.Fatalf("second Lock = %v, want it locked by this process", err)
+	}
+	if cleared, err := s.ClearStaleLock("abc"); cleared || err != nil {
+		t.Errorf("ClearStaleLock = %v, %v on a live lock", cleared, err)
+	}
+
+	unlock()
+	if _, held := s.Holder("abc"); held {
+		t.Error("still held after unlock")
+	}
+	unlock, err = s.Lock("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
+
+func TestStaleLocks(t *testing.T) {
+	host, _ := os.Hostname()
+	// no system hands out pids this high
+	dead := 1 << 30
+
+	type lockCase struct {
+		name  string
+		info  LockInfo
+		stale bool
+	}
+	tests := []lockCase{
+		{name: "dead pid", info: LockInfo{PID: dead, Host: host, Started: time.Now()}, stale: true},
+		// a lock from another machine can't be checked and is trusted
+		{name: "other host", info: LockInfo{PID: dead, Host: host + "-other", Started: time.Now()}, stale: false},
+	}
+	if started, ok := processStarted(os.Getpid()); ok {
+		// this process got the pid after the holder of a lock this old
+		tests = append(tests, lockCase{name: "reused pid", info: LockInfo{PID: os.Getpid(), Host: host, Started: started.Add(-time.Hour)}, stale: true})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t)
+			writeLock(t, s, "abc", tt.info)
+			if _, held := s.Holder("abc"); held == tt.stale {
+				t.Fatalf("held %v, want %v", held, !tt.stale)
+			}
+			cleared, err := s.ClearStaleLock("abc")
+			if err != nil || cleared != tt.stale {
+				t.Fatalf("ClearStaleLock = %v, %v, want %v", cleared, err, tt.stale)
+			}
+			if _, err := os.Stat(s.lockPath("abc")); os.IsNotExist(err) != tt.stale {
+				t.Errorf("lock file there: %v", err)
+			}
+
+			// Lock clears a stale lock by itself
+			writeLock(t, s, "abc", tt.info)
+			unlock, err := s.Lock("abc")
+			if tt.stale && err != nil {
+				t.Fatalf("Lock over a stale lock: %v", err)
+			}
+			if !tt.stale && !errors.Is(err, ErrSessionLocked) {
+				t.Fatalf("Lock = %v, want ErrSessionLocked", err)
+			}
+			if unlock != nil {
+				unlock()
+			}
+		})
+	}
+}
+
+func TestEmptyLockGracePeriod(t *testing.T) {
+	s := newTestStore(t)
+	path := s.lockPath("abc")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the holder may still be writing it
+	if _, held := s.Holder("abc"); !held {
+		t.Fatal("fresh empty lock not held")
+	}
+	_, err := s.Lock("abc")
+	if !errors.Is(err, ErrSessionLocked) || !strings.Contains(err.Error(), "being started") {
+		t.Fatalf("Lock = %v, want it being started by another process", err)
+	}
+
+	old := time.Now().Add(-2 * staleEmptyLock)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, held := s.Holder("abc"); held {
+		t.Fatal("old empty lock still held")
+	}
+	if cleared, err := s.ClearStaleLock("abc"); !cleared || err != nil {
+		t.Fatalf("ClearStaleLock = %v, %v", cleared, err)
+	}
+}
+
+func TestTakeoverGuard(t *testing.T) {
+	s := newTestStore(t)
+	host, _ := os.Hostname()
+	writeLock(t, s, "abc", LockInfo{PID: 1 << 30, Host: host, Started: time.Now()})
+	guard := s.lockPath("abc") + ".takeover"
+	if err := os.WriteFile(guard, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// another process is taking the lock over, leave it to that one
+	if cleared, err := s.ClearStaleLock("abc"); cleared || err != nil {
+		t.Fatalf("ClearStaleLock = %v, %v during a takeover", cleared, err)
+	}
+	if _, err := os.Stat(s.lockPath("abc")); err != nil {
+		t.Fatalf("lock removed during a takeover: %v", err)
+	}
+
+	// and if that process died its guard goes
+	old := time.Now().Add(-2 * staleEmptyLock)
+	os.Chtimes(guard, old, old)
+	// the first call removes the guard, the next one the lock
+	s.ClearStaleLock("abc")
+	if cleared, err := s.ClearStaleLock("abc"); !cleared || err != nil {
+		t.Fatalf("ClearStaleLock = %v, %v after the guard went stale", cleared, err)
+	}
+}
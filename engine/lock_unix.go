@@ -0,0 +1,15 @@
+//go:build !windows
+
+package engine
+
+import (
+	"errors"
+	"syscall"
+)
+
+// processAlive reports whether pid exists. EPERM means it does but
+// belongs to someone else.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,38 @@
+//go:build windows
+
+package engine
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// processAlive reports whether pid exists. On Windows FindProcess opens
+// the process and fails when there is none.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// processQueryLimitedInformation is PROCESS_QUERY_LIMITED_INFORMATION,
+// enough to read the times of another user's process.
+const processQueryLimitedInformation = 0x1000
+
+// processStarted reports when pid started, false if it can't be told.
+func processStarted(pid int) (time.Time, bool) {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer syscall.CloseHandle(h)
+	var created, exited, kernel, user syscall.Filetime
+	if err := syscall.GetProcessTimes(h, &created, &exited, &kernel, &user); err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, created.Nanoseconds()), true
+}
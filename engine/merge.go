@@ -0,0 +1,54 @@
+package engine
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// mergeParts joins the part files into filename, in the order of parts
+// which is their order in the file. Everything written also goes
+// through h, so the digest costs no second read of the file. A part
+// file of the wrong size fails the merge before anything is written.
+func mergeParts(filename string, parts []*Part, h hash.Hash, emit func(Event)) error {
+	for _, part := range parts {
+		// a part without a known end is the whole body
+		if part.End < 0 {
+			continue
+		}
+		info, err := os.Stat(partFileName(filename, part.ID))
+		if err != nil {
+			return err
+		}
+		if want := part.End - part.Start + 1; info.Size() != want {
+			return fmt.Errorf("part %d has %d bytes, expected %d", part.ID, info.Size(), want)
+		}
+	}
+
+	destFile, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+	dest := io.MultiWriter(destFile, h)
+
+	for i, part := range parts {
+		partPath := partFileName(filename, part.ID)
+
+		partFile, err := os.Open(partPath)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(dest, partFile)
+		partFile.Close()
+
+		if err != nil {
+			return err
+		}
+		os.Remove(partPath)
+		emit(MergeEvent{Part: i + 1, Total: len(parts)})
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMergeChecksPartSizes(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "file.bin")
+	parts := []*Part{{ID: 0, Start: 0, End: 9}, {ID: 1, Start: 10, End: 19}}
+	os.WriteFile(partFileName(filename, 0), []byte("0123456789"), 0644)
+	// a crash left the second part short
+	os.WriteFile(partFileName(filename, 1), []byte("abcde"), 0644)
+
+	err := mergeParts(filename, parts, sha256.New(), func(Event) {})
+	if err == nil || !strings.Contains(err.Error(), "part 1 has 5 bytes, expected 10") {
+		t.Fatalf("merge = %v, want the short part named", err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Error("output written before the parts were checked")
+	}
+
+	os.WriteFile(partFileName(filename, 1), []byte("abcdefghij"), 0644)
+	if err := mergeParts(filename, parts, sha256.New(), func(Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filename); string(got) != "0123456789abcdefghij" {
+		t.Errorf("merged %q", got)
+	}
+}
@@ -0,0 +1,101 @@
+package engine
+
+import (
+	"context"
+	"sync"
+)
+
+// workerPool limits how many parts download at once. Unlike a plain
+// semaphore its limit can move while workers wait for a slot.
+type workerPool struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	// wake is closed and replaced whenever a slot may have opened up
+	wake chan struct{}
+}
+
+func newWorkerPool(limit int) *workerPool {
+	return &workerPool{limit: max(limit, 1), wake: make(chan struct{})}
+}
+
+// acquire waits for a free slot. It returns false if ctx ends first.
+func (p *workerPool) acquire(ctx context.Context) bool {
+	for {
+		p.mu.Lock()
+		if p.running < p.limit {
+			p.running++
+			p.mu.Unlock()
+			return true
+		}
+		wake := p.wake
+		p.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (p *workerPool) release() {
+	p.mu.Lock()
+	p.running--
+	p.broadcast()
+	p.mu.Unlock()
+}
+
+// setLimit changes the number of slots. Workers above a lowered limit
+// keep going, the next ones to ask wait.
+func (p *workerPool) setLimit(n int) {
+	p.mu.Lock()
+	p.limit = max(n, 1)
+	p.broadcast()
+	p.mu.Unlock()
+}
+
+// yield gives the slot up and waits for one again, so that workers
+// above a lowered limit make way. If ctx ends first it takes the slot
+// back anyway and returns false, the caller always holds one after.
+func (p *workerPool) yield(ctx context.Context) bool {
+	p.release()
+	if p.acquire(ctx) {
+		return true
+	}
+	p.mu.Lock()
+	p.running++
+	p.mu.Unlock()
+	return false
+}
+
+// over reports whether more workers run than the limit allows.
+func (p *workerPool) over() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running > p.limit
+}
+
+// lower sets the limit to one less than the workers running, which
+// were too many, and returns it. While more run than the limit allows
+// the pushback is on those and the limit stays, it reports false then.
+func (p *workerPool) lower() (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running > p.limit {
+		return p.limit, false
+	}
+	p.limit = max(p.running-1, 1)
+	return p.limit, true
+}
+
+func (p *workerPool) getLimit() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.limit
+}
+
+func (p *workerPool) broadcast() {
+	close(p.wake)
+	p.wake = make(chan struct{})
+}
@@ -0,0 +1,149 @@
+package engine
+
+import (
+	"context"
+	"sync"
+)
+
+// PartProgress is a snapshot of one worker's byte range.
+type PartProgress struct {
+	ID       int
+	Start    int64
+	End      int64
+	Received int64
+}
+
+// LinkProgress is the traffic over one local interface or address.
+type LinkProgress struct {
+	Name        string
+	BytesPerSec float64
+	Received    int64
+	Connections int
+}
+
+// Progress is a snapshot of a running download.
+type Progress struct {
+	TotalSize int64
+	Received  int64
+	Parts     []PartProgress
+	// Protocol is what the server answered with, e.g. "HTTP/2.0", and
+	// Connections how many the workers are reading from. Over HTTP/2
+	// that is one for all of them.
+	Protocol    string
+	Connections int
+	// Links is the traffic per local interface or address, when the
+	// download is bound to some.
+	Links []LinkProgress
+}
+
+// tracker keeps per worker byte counts and the pause gate.
+type tracker struct {
+	mu    sync.RWMutex
+	parts map[int]*PartProgress
+
+	pauseMu sync.RWMutex
+	paused  bool
+	pauseCh chan struct{}
+}
+
+func newTracker() *tracker {
+	return &tracker{
+		parts:   make(map[int]*PartProgress),
+		pauseCh: make(chan struct{}),
+	}
+}
+
+// register workers byte range
+func (t *tracker) register(id int, start, end int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.parts[id] = &PartProgress{ID: id, Start: start, End: end}
+}
+
+// setEnd moves the end of a part whose tail was given to another one.
+func (t *tracker) setEnd(id int, end int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.parts[id]; ok {
+		p.End = end
+	}
+}
+
+// update workers downloaded bytes
+func (t *tracker) update(id int, received int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.parts[id]; ok {
+		p.Received = received
+	}
+}
+
+func (t *tracker) received(id int) int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if p, ok := t.parts[id]; ok {
+		return p.Received
+	}
+	return 0
+}
+
+func (t *tracker) totalReceived() int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var total int64
+	for _, p := range t.parts {
+		total += p.Received
+	}
+	return total
+}
+
+func (t *tracker) snapshot() []PartProgress {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	parts := make([]PartProgress, 0, len(t.parts))
+	for _, p := range t.parts {
+		parts = append(parts, *p)
+	}
+	return parts
+}
+
+func (t *tracker) pause() {
+	t.pauseMu.Lock()
+	defer t.pauseMu.Unlock()
+	if !t.paused {
+		t.paused = true
+		t.pauseCh = make(chan struct{})
+	}
+}
+
+func (t *tracker) resume() {
+	t.pauseMu.Lock()
+	defer t.pauseMu.Unlock()
+	if t.paused {
+		t.paused = false
+		close(t.pauseCh)
+	}
+}
+
+func (t *tracker) isPaused() bool {
+	t.pauseMu.RLock()
+	defer t.pauseMu.RUnlock()
+	return t.paused
+}
+
+// waitIfPaused blocks until resumed or ctx is cancelled.
+func (t *tracker) waitIfPaused(ctx context.Context) {
+	t.pauseMu.RLock()
+	if t.paused {
+		ch := t.pauseCh
+		t.pauseMu.RUnlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+		}
+		return
+	}
+	t.pauseMu.RUnlock()
+}
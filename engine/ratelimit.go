@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by all workers of a download,
+// so the limit applies to the sum of their speeds.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns nil for no limit, a nil limiter never waits.
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate: float64(bytesPerSec),
+		last: time.Now(),
+	}
+}
+
+// readSize keeps single reads small enough that the limiter can pace
+// them smoothly, about a tenth of a second worth of data.
+func (r *rateLimiter) readSize(max int) int {
+	if r == nil {
+		return max
+	}
+	size := int(r.rate / 10)
+	if size < 1024 {
+		size = 1024
+	}
+	if size > max {
+		size = max
+	}
+	return size
+}
+
+// wait takes n bytes from the bucket, sleeping if it ran dry.
+func (r *rateLimiter) wait(ctx context.Context, n int) error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate // allow at most one second of burst
+	}
+	r.last = now
+	r.tokens -= float64(n)
+
+	var delay time.Duration
+	if r.tokens < 0 {
+		delay = time.Duration(-r.tokens / r.rate * float64(time.Second))
+	}
+	r.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,372 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// parseResolve reads a curl style "host:port:addr[,addr...]" entry.
+func parseResolve(entry string) (hostport string, addrs []netip.Addr, err error) {
+	host, rest, ok := strings.Cut(entry, ":")
+	port, list, ok2 := strings.Cut(rest, ":")
+	if !ok || !ok2 || host == "" || port == "" || list == "" {
+		return "", nil, fmt.Errorf("invalid resolve entry '%s', want host:port:addr", entry)
+	}
+	for _, a := range strings.Split(list, ",") {
+		addr, err := netip.ParseAddr(strings.Trim(strings.TrimSpace(a), "[]"))
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid address '%s' in resolve entry '%s'", a, entry)
+		}
+		addrs = append(addrs, addr)
+	}
+	return net.JoinHostPort(host, port), addrs, nil
+}
+
+// isDoH tells a DNS-over-HTTPS url from a plain DNS server address.
+func isDoH(server string) bool {
+	return strings.HasPrefix(server, "https://") || strings.HasPrefix(server, "http://")
+}
+
+// dialer connects to the addresses a host resolves to. It looks them
+// all up once per download, gives each new connection the healthy
+// address with the fewest connections open so the workers spread over
+// all of them, and drops addresses that can't be reached.
+type dialer struct {
+	net       net.Dialer
+	lookup    func(ctx context.Context, host string) ([]netip.Addr, error)
+	ipVersion int
+	overrides map[string][]netip.Addr
+	// links are the local interfaces or addresses to connect from,
+	// none leaves it to the system
+	links []*link
+	debug func(string)
+
+	mu    sync.Mutex
+	hosts map[string]*hostAddrs
+}
+
+// hostAddrs are the addresses of one host:port.
+type hostAddrs struct {
+	addrs []netip.Addr
+	open  map[netip.Addr]int
+	bad   map[netip.Addr]bool
+}
+
+func newDialer(s Settings, debug func(string)) *dialer {
+	d := &dialer{
+		net: net.Dialer{
+			Timeout:   orDefault(s.ConnectTimeout, DefaultConnectTimeout),
+			KeepAlive: 30 * time.Second,
+		},
+		ipVersion: s.IPVersion,
+		overrides: make(map[string][]netip.Addr),
+		debug:     debug,
+		hosts:     make(map[string]*hostAddrs),
+	}
+	// Validate has turned down the broken ones
+	for _, entry := range s.Resolve {
+		if hostport, addrs, err := parseResolve(entry); err == nil {
+			d.overrides[hostport] = addrs
+		}
+	}
+	d.links, _ = parseLinks(s)
+
+	network := "ip"
+	switch s.IPVersion {
+	case 4:
+		network = "ip4"
+	case 6:
+		network = "ip6"
+	}
+	switch {
+	case s.DNSServer == "":
+		d.lookup = func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, network, host)
+		}
+	case isDoH(s.DNSServer):
+		client := &http.Client{Timeout: orDefault(s.HeaderTimeout, DefaultHeaderTimeout)}
+		d.lookup = func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return dohLookup(ctx, client, s.DNSServer, host, s.IPVersion)
+		}
+	default:
+		server := s.DNSServer
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		r := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return d.net.DialContext(ctx, network, server)
+			},
+		}
+		d.lookup = func(ctx context.Context, host string) ([]netip.Addr, error) {
+			addrs, err := r.LookupNetIP(ctx, network, host)
+			// the error names the server of resolv.conf, not the one asked
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) {
+				dnsErr.Server = server
+			}
+			return addrs, err
+		}
+	}
+	return d
+}
+
+// resolve returns the addresses of hostport, looking them up the first
+// time it is asked.
+func (d *dialer) resolve(ctx context.Context, hostport string) (*hostAddrs, error) {
+	d.mu.Lock()
+	h, ok := d.hosts[hostport]
+	d.mu.Unlock()
+	if ok {
+		return h, nil
+	}
+
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	addrs, ok := d.overrides[hostport]
+	if !ok {
+		if ip, err := netip.ParseAddr(host); err == nil {
+			addrs = []netip.Addr{ip}
+		} else if addrs, err = d.lookup(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+
+	var usable []netip.Addr
+	for _, a := range addrs {
+		a = a.Unmap()
+		if (d.ipVersion == 4 && !a.Is4()) || (d.ipVersion == 6 && !a.Is6()) {
+			continue
+		}
+		usable = append(usable, a)
+	}
+	if len(usable) == 0 {
+		return nil, fmt.Errorf("no IPv%d address for %s", d.ipVersion, host)
+	}
+	if len(usable) > 1 {
+		d.debug(fmt.Sprintf("%s resolves to %d addresses: %v", host, len(usable), usable))
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// a worker that raced us here may have stored them already
+	if h, ok := d.hosts[hostport]; ok {
+		return h, nil
+	}
+	h = &hostAddrs{addrs: usable, open: make(map[netip.Addr]int), bad: make(map[netip.Addr]bool)}
+	d.hosts[hostport] = h
+	return h, nil
+}
+
+// pick takes the healthy address with the fewest connections open.
+// When all of them failed they get another chance.
+func (d *dialer) pick(h *hostAddrs) netip.Addr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(h.bad) >= len(h.addrs) {
+		clear(h.bad)
+	}
+	var best netip.Addr
+	for _, a := range h.addrs {
+		if h.bad[a] {
+			continue
+		}
+		if !best.IsValid() || h.open[a] < h.open[best] {
+			best = a
+		}
+	}
+	h.open[best]++
+	return best
+}
+
+func (d *dialer) release(h *hostAddrs, a netip.Addr) {
+	d.mu.Lock()
+	h.open[a]--
+	d.mu.Unlock()
+}
+
+func (d *dialer) drop(h *hostAddrs, a netip.Addr, err error) {
+	d.mu.Lock()
+	h.bad[a] = true
+	d.mu.Unlock()
+	d.debug(fmt.Sprintf("Dropping %s: %v", a, err))
+}
+
+func (d *dialer) DialContext(ctx context.Context, network, hostport string) (net.Conn, error) {
+	h, err := d.resolve(ctx, hostport)
+	if err != nil {
+		return nil, err
+	}
+	_, port, _ := net.SplitHostPort(hostport)
+
+	var lastErr error
+	for range h.addrs {
+		a := d.pick(h)
+		conn, l, err := d.dial(ctx, network, a, port)
+		if err == nil {
+			return &trackedConn{Conn: conn, link: l, done: func() {
+				d.release(h, a)
+				if l != nil {
+					d.releaseLink(l)
+				}
+			}}, nil
+		}
+		d.release(h, a)
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if len(h.addrs) > 1 {
+			d.drop(h, a, err)
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// dial connects to a, from the least busy link if there are any.
+func (d *dialer) dial(ctx context.Context, network string, a netip.Addr, port string) (net.Conn, *link, error) {
+	hostport := net.JoinHostPort(a.String(), port)
+	if len(d.links) == 0 {
+		conn, err := d.net.DialContext(ctx, network, hostport)
+		return conn, nil, err
+	}
+	l, src := d.pickLink(a)
+	if l == nil {
+		return nil, nil, fmt.Errorf("no local address can reach %s", a)
+	}
+	conn, err := d.netDialer(l, src).DialContext(ctx, network, hostport)
+	if err != nil {
+		d.releaseLink(l)
+		return nil, nil, fmt.Errorf("connecting from %s: %w", l.name, err)
+	}
+	return conn, l, nil
+}
+
+// dialQUIC is DialContext for HTTP/3. QUIC carries every worker over
+// one connection, so there is nothing to spread, but it goes to the
+// same addresses.
+func (d *dialer) dialQUIC(ctx context.Context, hostport string, tlsConf *tls.Config, conf *quic.Config) (*quic.Conn, error) {
+	h, err := d.resolve(ctx, hostport)
+	if err != nil {
+		return nil, err
+	}
+	_, port, _ := net.SplitHostPort(hostport)
+	a := d.pick(h)
+	d.release(h, a)
+	return quic.DialAddrEarly(ctx, net.JoinHostPort(a.String(), port), tlsConf, conf)
+}
+
+// trackedConn tells the dialer when a connection is closed, and counts
+// what it reads for its link.
+type trackedConn struct {
+	net.Conn
+	link *link
+	once sync.Once
+	done func()
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.link != nil {
+		c.link.received.Add(int64(n))
+	}
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.done)
+	return c.Conn.Close()
+}
+
+// dohLookup asks a DNS-over-HTTPS server (RFC 8484) for the addresses
+// of host, A and AAAA records as ipVersion allows.
+func dohLookup(ctx context.Context, client *http.Client, server, host string, ipVersion int) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	var lastErr error
+	for _, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		if (t == dnsmessage.TypeA && ipVersion == 6) || (t == dnsmessage.TypeAAAA && ipVersion == 4) {
+			continue
+		}
+		got, err := dohQuery(ctx, client, server, host, t)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		addrs = append(addrs, got...)
+	}
+	if len(addrs) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("%s has no addresses", host)
+		}
+		return nil, fmt.Errorf("looking up %s: %w", host, lastErr)
+	}
+	return addrs, nil
+}
+
+func dohQuery(ctx context.Context, client *http.Client, server, host string, t dnsmessage.Type) ([]netip.Addr, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: t, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", server, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS server returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+
+	var reply dnsmessage.Message
+	if err := reply.Unpack(body); err != nil {
+		return nil, err
+	}
+	if reply.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("DNS server answered %s", reply.RCode)
+	}
+	var addrs []netip.Addr
+	for _, answer := range reply.Answers {
+		switch r := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, netip.AddrFrom4(r.A))
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, netip.AddrFrom16(r.AAAA))
+		}
+	}
+	return addrs, nil
+}
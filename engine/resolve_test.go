@@ -0,0 +1,258 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseResolve(t *testing.T) {
+	tests := []struct {
+		entry    string
+		hostport string
+		addrs    string
+		err      bool
+	}{
+		{entry: "example.com:443:203.0.113.7", hostport: "example.com:443", addrs: "[203.0.113.7]"},
+		{entry: "example.com:80:203.0.113.7, 203.0.113.8", hostport: "example.com:80", addrs: "[203.0.113.7 203.0.113.8]"},
+		{entry: "example.com:443:[2001:db8::1]", hostport: "example.com:443", addrs: "[2001:db8::1]"},
+		{entry: "example.com:443", err: true},
+		{entry: "example.com:443:nowhere", err: true},
+		{entry: ":443:203.0.113.7", err: true},
+	}
+	for _, tt := range tests {
+		hostport, addrs, err := parseResolve(tt.entry)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseResolve(%q) took it", tt.entry)
+			}
+			continue
+		}
+		if err != nil || hostport != tt.hostport || fmt.Sprint(addrs) != tt.addrs {
+			t.Errorf("parseResolve(%q) = %s, %v, %v", tt.entry, hostport, addrs, err)
+		}
+	}
+}
+
+func TestPickSpreadsAndDrops(t *testing.T) {
+	d := newDialer(Settings{}, func(string) {})
+	a, b := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	h := &hostAddrs{addrs: []netip.Addr{a, b}, open: make(map[netip.Addr]int), bad: make(map[netip.Addr]bool)}
+
+	for range 4 {
+		d.pick(h)
+	}
+	if h.open[a] != 2 || h.open[b] != 2 {
+		t.Errorf("connections %v, want two on each", h.open)
+	}
+	d.drop(h, a, fmt.Errorf("refused"))
+	if got := d.pick(h); got != b {
+		t.Errorf("picked %s after dropping it", got)
+	}
+	// with every address dropped they all get another chance
+	d.drop(h, b, fmt.Errorf("refused"))
+	if got := d.pick(h); !got.IsValid() || len(h.bad) != 0 {
+		t.Errorf("picked %v with %d bad, want a fresh start", got, len(h.bad))
+	}
+}
+
+// dnsAnswer answers a packed DNS query with the A records in hosts,
+// NXDOMAIN for names it does not know.
+func dnsAnswer(t *testing.T, query []byte, hosts map[string][]netip.Addr) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		t.Errorf("bad DNS query: %v", err)
+		return nil
+	}
+	q := msg.Questions[0]
+	reply := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: msg.ID, Response: true, RecursionAvailable: true},
+		Questions: msg.Questions,
+	}
+	addrs, ok := hosts[q.Name.String()]
+	if !ok {
+		reply.RCode = dnsmessage.RCodeNameError
+	}
+	for _, a := range addrs {
+		if q.Type == dnsmessage.TypeA && a.Is4() {
+			reply.Answers = append(reply.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: a.As4()},
+			})
+		}
+	}
+	packed, err := reply.Pack()
+	if err != nil {
+		t.Error(err)
+	}
+	return packed
+}
+
+// dohServer is a DNS-over-HTTPS stand-in that counts its queries.
+type dohServer struct {
+	t       *testing.T
+	hosts   map[string][]netip.Addr
+	mu      sync.Mutex
+	queries int
+}
+
+func (s *dohServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.Header.Get("Content-Type") != "application/dns-message" {
+		http.Error(w, "want a POSTed dns-message", http.StatusBadRequest)
+		return
+	}
+	query, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	s.queries++
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(dnsAnswer(s.t, query, s.hosts))
+}
+
+// serveOn serves s on one port of every address, and counts the
+// connections each of them takes. Requests are not counted, a pooled
+// connection carries any number of them. The test is skipped where the
+// system can't listen on them, only Linux has all of 127/8 on loopback.
+func serveOn(t *testing.T, s http.Handler, addrs ...string) (port string, conns func() map[string]int) {
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	srv := &http.Server{Handler: s, ConnState: func(c net.Conn, state http.ConnState) {
+		if state != http.StateNew {
+			return
+		}
+		host, _, _ := net.SplitHostPort(c.LocalAddr().String())
+		mu.Lock()
+		counts[host]++
+		mu.Unlock()
+	}}
+	t.Cleanup(func() { srv.Close() })
+
+	port = "0"
+	for _, a := range addrs {
+		ln, err := net.Listen("tcp", net.JoinHostPort(a, port))
+		if err != nil {
+			t.Skipf("can't listen on %s: %v", a, err)
+		}
+		_, port, _ = net.SplitHostPort(ln.Addr().String())
+		go srv.Serve(ln)
+	}
+	return port, func() map[string]int {
+		mu.Lock()
+		defer mu.Unlock()
+		return maps.Clone(counts)
+	}
+}
+
+func TestResolveOverridesDNS(t *testing.T) {
+	s, _ := newFileServer(t, 2<<20)
+	port, conns := serveOn(t, s, "127.0.0.1")
+	rec := &recorder{}
+	opts := testOptions(t, rec)
+	opts.Workers = 2
+	// nothing listens on 127.0.0.2, it is dropped
+	opts.Resolve = []string{"files.test:" + port + ":127.0.0.2,127.0.0.1"}
+	opts.ConnectTimeout = time.Second
+	// no name server knows files.test, a lookup would fail
+	opts.DNSServer = "127.0.0.1:1"
+
+	d, err := download(t, "http://files.test:"+port+"/file.bin", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, d.State().Filename, s.data)
+	if n := conns()["127.0.0.1"]; n == 0 || len(s.requested()) != 2 {
+		t.Errorf("127.0.0.1 got %d connections for parts %v, want both parts", n, s.requested())
+	}
+	dropped := false
+	for _, msg := range rec.debug() {
+		dropped = dropped || strings.HasPrefix(msg, "Dropping 127.0.0.2")
+	}
+	if !dropped {
+		t.Errorf("unreachable address not dropped: %v", rec.debug())
+	}
+}
+
+func TestDoHLookupSpreadsConnections(t *testing.T) {
+	s, _ := newFileServer(t, 4<<20)
+	port, conns := serveOn(t, s, "127.0.0.2", "127.0.0.3")
+	doh := &dohServer{t: t, hosts: map[string][]netip.Addr{
+		"files.test.": {netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("127.0.0.3")},
+	}}
+	dohSrv := httptest.NewServer(doh)
+	t.Cleanup(dohSrv.Close)
+
+	rec := &recorder{}
+	opts := testOptions(t, rec)
+	opts.Workers = 4
+	opts.DNSServer = dohSrv.URL + "/dns-query"
+
+	d, err := download(t, "http://files.test:"+port+"/file.bin", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, d.State().Filename, s.data)
+
+	// looked up once for the whole download, A and AAAA
+	doh.mu.Lock()
+	queries := doh.queries
+	doh.mu.Unlock()
+	if queries != 2 {
+		t.Errorf("DoH server got %d queries, want 2", queries)
+	}
+	// the dialer puts every new connection on the least used address
+	got := conns()
+	if got["127.0.0.2"] == 0 || got["127.0.0.3"] == 0 {
+		t.Errorf("connections per address %v, want them spread over both", got)
+	}
+}
+
+func TestDoHLookupFailure(t *testing.T) {
+	doh := &dohServer{t: t}
+	dohSrv := httptest.NewServer(doh)
+	t.Cleanup(dohSrv.Close)
+	d := newDialer(Settings{DNSServer: dohSrv.URL}, func(string) {})
+
+	_, err := d.resolve(context.Background(), "nowhere.test:80")
+	if err == nil || !strings.Contains(err.Error(), "looking up nowhere.test") || !strings.Contains(err.Error(), "NameError") {
+		t.Errorf("resolve = %v, want the host and the answer named", err)
+	}
+}
+
+func TestDNSServerLookup(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	hosts := map[string][]netip.Addr{"files.test.": {netip.MustParseAddr("127.0.0.1")}}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(dnsAnswer(t, buf[:n], hosts), from)
+		}
+	}()
+
+	d := newDialer(Settings{DNSServer: conn.LocalAddr().String(), IPVersion: 4}, func(string) {})
+	h, err := d.resolve(context.Background(), "files.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(h.addrs) != "[127.0.0.1]" {
+		t.Errorf("files.test resolved to %v", h.addrs)
+	}
+}
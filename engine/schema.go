@@ -0,0 +1,103 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// StateVersion is the version of the state files this build writes.
+// Bump it and add a migration whenever the meaning of a saved field
+// changes.
+const StateVersion = 3
+
+var ErrStateTooNew = errors.New("session was saved by a newer version of adam")
+
+// migrations[i] upgrades a raw state from version i+1 to i+2. file is
+// the state file path without the .json suffix.
+var migrations = []func(m map[string]any, file string) error{
+	migrateV1,
+	migrateV2,
+}
+
+// migrateV1 upgrades files from before versions existed. Sessions were
+// stored under their output file name, which becomes their ID.
+func migrateV1(m map[string]any, file string) error {
+	if id, _ := m["id"].(string); id == "" {
+		m["id"] = filepath.Base(file)
+	}
+	return nil
+}
+
+// migrateV2 adds the timestamps. Older files only have their
+// modification time to go by.
+func migrateV2(m map[string]any, file string) error {
+	st, err := os.Stat(file + ".json")
+	if err != nil {
+		return err
+	}
+	mtime := st.ModTime()
+	m["created"] = mtime
+	m["updated"] = mtime
+
+	parts, _ := m["parts"].([]any)
+	done := len(parts) > 0
+	for _, p := range parts {
+		part, _ := p.(map[string]any)
+		if complete, _ := part["is_complete"].(bool); !complete {
+			done = false
+		}
+	}
+	if done {
+		m["completed"] = mtime
+	}
+	return nil
+}
+
+// decodeState reads a state file of any known version into the current
+// layout.
+func decodeState(data []byte, file string) (*DownloadState, error) {
+	var m map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// keep sizes as they are instead of going through float64
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+
+	version := 1
+	if v, ok := m["version"]; ok {
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("invalid state version %v", v)
+		}
+		i, err := n.Int64()
+		if err != nil || i < 1 {
+			return nil, fmt.Errorf("invalid state version %v", v)
+		}
+		version = int(i)
+	}
+	if version > StateVersion {
+		return nil, fmt.Errorf("%w (state version %d, this build reads up to %d)", ErrStateTooNew, version, StateVersion)
+	}
+
+	for ; version < StateVersion; version++ {
+		if err := migrations[version-1](m, file); err != nil {
+			return nil, fmt.Errorf("upgrading state from version %d: %v", version, err)
+		}
+	}
+	m["version"] = StateVersion
+
+	upgraded, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	state := &DownloadState{}
+	if err := json.Unmarshal(upgraded, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
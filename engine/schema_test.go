@@ -0,0 +1,99 @@
+package engine
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeState(t *testing.T) {
+	mtime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	v1 := `{"url": "http://example.com/a.iso", "filename": "a.iso", "total_size": 9007199254740993,
+		"parts": [{"id": 0, "start": 0, "end": 9, "is_complete": true}]}`
+
+	tests := []struct {
+		name string
+		data string
+		// check looks at the decoded state, err is what has to be in
+		// the error instead
+		check func(t *testing.T, s *DownloadState)
+		err   string
+	}{
+		{
+			name: "v1 without version or id",
+			data: v1,
+			check: func(t *testing.T, s *DownloadState) {
+				if s.ID != "a.iso" {
+					t.Errorf("id %q, want the file name", s.ID)
+				}
+				if s.Version != StateVersion {
+					t.Errorf("version %d, want %d", s.Version, StateVersion)
+				}
+				if !s.Created.Equal(mtime) || !s.Updated.Equal(mtime) || !s.Completed.Equal(mtime) {
+					t.Errorf("times %v %v %v, want the file's %v", s.Created, s.Updated, s.Completed, mtime)
+				}
+				// a size past 2^53 would change going through a float
+				if s.TotalSize != 9007199254740993 {
+					t.Errorf("size %d", s.TotalSize)
+				}
+			},
+		},
+		{
+			name: "v2 keeps its id",
+			data: `{"version": 2, "id": "3fa9c2d1", "url": "http://example.com/a.iso",
+				"parts": [{"id": 0, "start": 0, "end": 9}]}`,
+			check: func(t *testing.T, s *DownloadState) {
+				if s.ID != "3fa9c2d1" || !s.Created.Equal(mtime) || !s.Completed.IsZero() {
+					t.Errorf("id %q, created %v, completed %v", s.ID, s.Created, s.Completed)
+				}
+			},
+		},
+		{
+			name: "current version is left alone",
+			data: `{"version": 3, "id": "3fa9c2d1", "created": "2020-01-01T00:00:00Z"}`,
+			check: func(t *testing.T, s *DownloadState) {
+				if !s.Created.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) {
+					t.Errorf("created %v, want it as saved", s.Created)
+				}
+			},
+		},
+		{name: "too new", data: `{"version": 99}`, err: "newer version"},
+		{name: "version not a number", data: `{"version": "x"}`, err: "invalid state version"},
+		{name: "version zero", data: `{"version": 0}`, err: "invalid state version"},
+		{name: "not json", data: `{"version":`, err: "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "a.iso")
+			if err := os.WriteFile(file+".json", []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			os.Chtimes(file+".json", mtime, mtime)
+
+			s, err := decodeState([]byte(tt.data), file)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("decodeState = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, s)
+		})
+	}
+
+	_, err := decodeState([]byte(`{"version": 99}`), "x")
+	if !errors.Is(err, ErrStateTooNew) {
+		t.Errorf("version 99: %v, want ErrStateTooNew", err)
+	}
+	// migrateV2 needs the file for its times
+	_, err = decodeState([]byte(v1), filepath.Join(t.TempDir(), "gone"))
+	if err == nil || !strings.Contains(err.Error(), "upgrading state from version 2") {
+		t.Errorf("upgrade without the file: %v", err)
+	}
+}
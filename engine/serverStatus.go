@@ -0,0 +1,59 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var ErrNoRangeSupport = errors.New("server does not support range requests")
+
+// ServerInfo is what the server said about the file when it was probed.
+type ServerInfo struct {
+	// FinalURL is the url after redirects.
+	FinalURL     string `json:"final_url,omitempty"`
+	ContentType  string `json:"content_type,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Server       string `json:"server,omitempty"`
+	Protocol     string `json:"protocol,omitempty"`
+}
+
+func checkServerSupport(ctx context.Context, client *http.Client, url string, headers []string) (int64, *ServerInfo, error) {
+	req, err := newRequest(ctx, url, headers)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	info := &ServerInfo{
+		FinalURL:     resp.Request.URL.String(),
+		ContentType:  resp.Header.Get("Content-Type"),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Server:       resp.Header.Get("Server"),
+		Protocol:     resp.Proto,
+	}
+
+	if resp.StatusCode == http.StatusPartialContent {
+		parts := strings.Split(resp.Header.Get("Content-Range"), "/")
+		if len(parts) == 2 {
+			size, _ := strconv.ParseInt(parts[1], 10, 64)
+			return size, info, nil
+		}
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		return 0, info, ErrNoRangeSupport
+	}
+	return 0, nil, fmt.Errorf("server returned unexpected status: %s", resp.Status)
+}
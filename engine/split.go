@@ -0,0 +1,185 @@
+package engine
+
+import (
+	"os"
+	"sort"
+)
+
+const (
+	// DefaultMinPartSize is the smallest part worth its own connection
+	// when Settings.MinPartSize is 0. Files under twice that download
+	// over one.
+	DefaultMinPartSize = 1 << 20
+	// defaultBlockSize keeps part boundaries on page boundaries when
+	// Settings.BlockSize is 0.
+	defaultBlockSize = 4 << 10
+)
+
+// planner decides where parts begin and end, for new downloads, for
+// resumes with more workers and for work stealing alike. No part is
+// cut smaller than minSize and every boundary is a multiple of block.
+type planner struct {
+	minSize int64
+	block   int64
+}
+
+func newPlanner(s Settings) planner {
+	p := planner{minSize: s.MinPartSize, block: s.BlockSize}
+	if p.minSize == 0 {
+		p.minSize = DefaultMinPartSize
+	}
+	if p.block == 0 {
+		p.block = defaultBlockSize
+	}
+	return p
+}
+
+// boundary picks the multiple of block closest to at that leaves at
+// least minSize on either side of it within [from, to]. It returns -1
+// if there is none.
+func (pl planner) boundary(from, at, to int64) int64 {
+	down := at / pl.block * pl.block
+	best := int64(-1)
+	for _, b := range []int64{down, down + pl.block} {
+		if b-from < pl.minSize || to-b+1 < pl.minSize {
+			continue
+		}
+		if best < 0 || b-at < at-best {
+			best = b
+		}
+	}
+	return best
+}
+
+// plan lays out a new download of size bytes over up to workers parts.
+// An unknown size, 0, gives one part that runs to the end of the body.
+func (pl planner) plan(size int64, workers int) []*Part {
+	parts := []*Part{{ID: 0, Start: 0, End: size - 1}}
+	n := min(int64(workers), size/pl.minSize)
+	for i := int64(1); i < n; i++ {
+		last := parts[len(parts)-1]
+		b := pl.boundary(last.Start, size*i/n, size-1)
+		if b < 0 {
+			continue
+		}
+		last.End = b - 1
+		parts = append(parts, &Part{ID: len(parts), Start: b, End: size - 1})
+	}
+	return parts
+}
+
+// cut gives the back half of what is left of p to a new part with id.
+// p keeps what it downloaded and the front of the rest. It returns nil
+// if that would leave a part under minSize.
+func (pl planner) cut(p *Part, id int) *Part {
+	if p.IsComplete {
+		return nil
+	}
+	from := p.Start + max(p.written, p.CurrentOffset)
+	b := pl.boundary(from, from+(p.End-from+1)/2, p.End)
+	if b < 0 {
+		return nil
+	}
+	part := &Part{ID: id, Start: b, End: p.End}
+	p.End = b - 1
+	return part
+}
+
+// left is how much of a part nobody has written yet. A running worker
+// is ahead of CurrentOffset by what it has not synced.
+func (p *Part) left() int64 {
+	return p.End - p.Start + 1 - max(p.written, p.CurrentOffset)
+}
+
+// widestPart is the unfinished part with the most left to do.
+func widestPart(parts []*Part) *Part {
+	var widest *Part
+	for _, p := range parts {
+		if !p.IsComplete && (widest == nil || p.left() > widest.left()) {
+			widest = p
+		}
+	}
+	return widest
+}
+
+func nextPartID(parts []*Part) int {
+	id := 0
+	for _, p := range parts {
+		if p.ID >= id {
+			id = p.ID + 1
+		}
+	}
+	return id
+}
+
+// insertPart adds part to parts keeping them in file order, which is
+// the order they are merged in.
+func insertPart(parts []*Part, part *Part) []*Part {
+	i := sort.Search(len(parts), func(i int) bool { return parts[i].Start > part.Start })
+	parts = append(parts, nil)
+	copy(parts[i+1:], parts[i:])
+	parts[i] = part
+	return parts
+}
+
+// splitParts cuts the unfinished ranges of state into more parts until
+// there are workers of them or pl finds them too small. It reports
+// whether the layout changed.
+func splitParts(state *DownloadState, workers int, pl planner) bool {
+	// without a size the server did not take ranges, one part it is
+	if state.TotalSize <= 0 {
+		return false
+	}
+
+	unfinished := 0
+	for _, p := range state.Parts {
+		if !p.IsComplete {
+			unfinished++
+		}
+	}
+
+	changed := false
+	for ; unfinished < workers; unfinished++ {
+		widest := widestPart(state.Parts)
+		if widest == nil {
+			break
+		}
+		part := pl.cut(widest, nextPartID(state.Parts))
+		if part == nil {
+			break
+		}
+		// a part file of this id may be left from an older layout
+		os.Remove(partFileName(state.Filename, part.ID))
+		state.Parts = insertPart(state.Parts, part)
+		changed = true
+	}
+	return changed
+}
+
+// steal takes the back half of the unfinished part with the most left
+// to do, which may be downloading right now, and returns it as a new
+// part. Its worker notices the lower end at its next write. It returns
+// nil when nothing is worth splitting.
+func (d *Downloader) steal() *Part {
+	if d.state.TotalSize <= 0 {
+		return nil
+	}
+
+	d.partMu.Lock()
+	defer d.partMu.Unlock()
+
+	widest := widestPart(d.state.Parts)
+	if widest == nil {
+		return nil
+	}
+	part := d.planner.cut(widest, nextPartID(d.state.Parts))
+	if part == nil {
+		return nil
+	}
+	os.Remove(partFileName(d.state.Filename, part.ID))
+	d.state.Parts = insertPart(d.state.Parts, part)
+
+	d.tracker.setEnd(widest.ID, widest.End)
+	d.tracker.register(part.ID, part.Start, part.End)
+	return part
+}
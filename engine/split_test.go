@@ -0,0 +1,79 @@
+package engine
+
+import "testing"
+
+func TestPlanLaysOutAlignedParts(t *testing.T) {
+	pl := newPlanner(Settings{})
+	tests := []struct {
+		size    int64
+		workers int
+		parts   int
+	}{
+		{size: 10<<20 + 1, workers: 4, parts: 4},
+		{size: 3 << 20, workers: 8, parts: 3},
+		// under twice the minimum part size one connection it is
+		{size: 2<<20 - 1, workers: 8, parts: 1},
+		{size: 0, workers: 8, parts: 1},
+	}
+	for _, tt := range tests {
+		parts := pl.plan(tt.size, tt.workers)
+		if len(parts) != tt.parts {
+			t.Errorf("plan(%d, %d) gave %d parts, want %d", tt.size, tt.workers, len(parts), tt.parts)
+			continue
+		}
+		next := int64(0)
+		for _, p := range parts {
+			if p.Start != next || p.Start%defaultBlockSize != 0 {
+				t.Errorf("plan(%d, %d): part %d starts at %d, want %d on a block", tt.size, tt.workers, p.ID, p.Start, next)
+			}
+			if tt.parts > 1 && p.End-p.Start+1 < DefaultMinPartSize {
+				t.Errorf("plan(%d, %d): part %d has %d bytes", tt.size, tt.workers, p.ID, p.End-p.Start+1)
+			}
+			next = p.End + 1
+		}
+		if next != tt.size {
+			t.Errorf("plan(%d, %d) ends at %d", tt.size, tt.workers, next)
+		}
+	}
+}
+
+func TestCutLeavesWhatWasWritten(t *testing.T) {
+	pl := newPlanner(Settings{MinPartSize: 1 << 20})
+	p := &Part{ID: 0, Start: 0, End: 8<<20 - 1, CurrentOffset: 1 << 20, written: 2 << 20}
+
+	cut := pl.cut(p, 1)
+	if cut == nil {
+		t.Fatal("nothing cut off")
+	}
+	// the worker is at 2 MiB, the rest is split down the middle
+	if cut.Start != 5<<20 || cut.End != 8<<20-1 || p.End != 5<<20-1 {
+		t.Errorf("cut into %d-%d and %d-%d", p.Start, p.End, cut.Start, cut.End)
+	}
+
+	small := &Part{ID: 0, Start: 0, End: 4<<20 - 1, written: 3 << 20}
+	if cut := pl.cut(small, 1); cut != nil {
+		t.Errorf("cut %d-%d off a part with 1 MiB left", cut.Start, cut.End)
+	}
+}
+
+func TestSplitPartsKeepsProgress(t *testing.T) {
+	state := &DownloadState{
+		Filename:  t.TempDir() + "/file.bin",
+		TotalSize: 8 << 20,
+		Parts:     []*Part{{ID: 0, Start: 0, End: 8<<20 - 1, CurrentOffset: 3 << 20}},
+	}
+	if !splitParts(state, 4, newPlanner(Settings{MinPartSize: 1 << 20})) {
+		t.Fatal("nothing split")
+	}
+	if len(state.Parts) != 4 {
+		t.Fatalf("got %d parts, want 4", len(state.Parts))
+	}
+	if first := state.Parts[0]; first.CurrentOffset != 3<<20 || first.End < 3<<20 {
+		t.Errorf("first part %d-%d at %d lost its progress", first.Start, first.End, first.CurrentOffset)
+	}
+	for i := 1; i < len(state.Parts); i++ {
+		if state.Parts[i].Start != state.Parts[i-1].End+1 {
+			t.Errorf("gap or overlap before part %d", state.Parts[i].ID)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package engine
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anuraggr/adam/util"
+)
+
+type Part struct {
+	ID            int   `json:"id"`
+	Start         int64 `json:"start"`
+	End           int64 `json:"end"`
+	CurrentOffset int64 `json:"current_offset"`
+	IsComplete    bool  `json:"is_complete"`
+	// RetryCount and RestartCount add up over all runs, for the history
+	RetryCount   int `json:"retries,omitempty"`
+	RestartCount int `json:"restarts,omitempty"`
+	// Protocol is what the server answered the last request for this
+	// part with, e.g. "HTTP/3.0"
+	Protocol string `json:"protocol,omitempty"`
+	// below fiels are non persistant
+	Restarts  int   `json:"-"`
+	LastBytes int64 `json:"-"`
+	// written is how far the running worker got, synced or not. End
+	// may only move down to it. Guarded by the downloader's partMu.
+	written int64
+	// conn is the connection the running worker reads from, guarded
+	// by partMu too
+	conn net.Conn
+	// failures counts the times the part used up its retries in this
+	// run, retryAt is when it may be tried again. Guarded by the
+	// downloader's spawnMu.
+	failures int
+	retryAt  time.Time
+}
+
+type DownloadState struct {
+	// Version is the layout of the saved file, see StateVersion.
+	Version int `json:"version"`
+	// ID names the session in the store, it stays the same for the
+	// life of the download.
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Filename is the absolute output path. Sessions saved before IDs
+	// existed may hold a path relative to where they were started.
+	Filename  string   `json:"filename"`
+	TotalSize int64    `json:"total_size"`
+	Parts     []*Part  `json:"parts"`
+	Headers   []string `json:"headers,omitempty"`
+	Checksum  string   `json:"checksum,omitempty"`
+	Group     string   `json:"group,omitempty"`
+	// GroupName is the pattern the group was started from, for display.
+	// Sessions from before it was kept hold the name in Group.
+	GroupName string `json:"group_name,omitempty"`
+	// Settings the session runs with, nil for sessions saved before
+	// they were recorded.
+	Settings *Settings `json:"settings,omitempty"`
+
+	Created time.Time `json:"created"`
+	// Updated is the time of the last save.
+	Updated   time.Time `json:"updated"`
+	Completed time.Time `json:"completed"`
+	// Elapsed is the time spent downloading, summed over all runs.
+	Elapsed time.Duration `json:"elapsed"`
+	// PeakSpeed is the fastest half second, in bytes per second.
+	PeakSpeed float64 `json:"peak_speed,omitempty"`
+	// Digest of the finished file, "<type>=<hex>" like Checksum.
+	Digest string      `json:"digest,omitempty"`
+	Server *ServerInfo `json:"server,omitempty"`
+	// LastError is why the last run stopped, empty if it didn't fail.
+	// LinkExpired is set when the url has to be replaced before the
+	// download can go on.
+	LastError   string `json:"last_error,omitempty"`
+	LinkExpired bool   `json:"link_expired,omitempty"`
+}
+
+// ErrSessionNotFound is returned when no session matches an ID or name.
+var ErrSessionNotFound = errors.New("no such session")
+
+// Store persists session state between runs. Sessions are addressed by
+// their ID.
+type Store interface {
+	Load(id string) (*DownloadState, error)
+	Save(state *DownloadState) error
+	// Complete marks a finished session, it no longer shows as resumable.
+	Complete(state *DownloadState) error
+	// Delete removes a session, ongoing or completed.
+	Delete(id string) error
+	// List returns the ongoing or the completed sessions, along with
+	// the ones that could not be read.
+	List(complete bool) ([]*DownloadState, []*SessionError)
+}
+
+// SessionError is a session that is in the store but can't be used,
+// for example because it was saved by a newer adam.
+type SessionError struct {
+	ID  string
+	Err error
+}
+
+func (e *SessionError) Error() string {
+	return fmt.Sprintf("session %s: %v", e.ID, e.Err)
+}
+
+func (e *SessionError) Unwrap() error {
+	return e.Err
+}
+
+// NewSessionID returns a random ID that is short enough to type.
+func NewSessionID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand does not fail on supported platforms
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// FindSession resolves ref to one ongoing session. ref may be a full
+// ID, the start of one, the output path or just its file name. Several
+// matches are an error so the wrong download is never touched.
+func FindSession(store Store, ref string) (*DownloadState, error) {
+	state, err := store.Load(ref)
+	if err == nil {
+		return state, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, &SessionError{ID: ref, Err: err}
+	}
+
+	sessions, _ := store.List(false)
+	return matchSession(sessions, ref)
+}
+
+// FindCompleted is FindSession for finished sessions.
+func FindCompleted(store Store, ref string) (*DownloadState, error) {
+	sessions, _ := store.List(true)
+	for _, state := range sessions {
+		if state.ID == ref {
+			return state, nil
+		}
+	}
+	return matchSession(sessions, ref)
+}
+
+func matchSession(sessions []*DownloadState, ref string) (*DownloadState, error) {
+	absRef, _ := filepath.Abs(ref)
+	var matches []*DownloadState
+	for _, state := range sessions {
+		if strings.HasPrefix(state.ID, ref) ||
+			state.Filename == absRef ||
+			filepath.Base(state.Filename) == ref {
+			matches = append(matches, state)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("%w: '%s'", ErrSessionNotFound, ref)
+	case 1:
+		return matches[0], nil
+	}
+	ids := make([]string, len(matches))
+	for i, m := range matches {
+		ids[i] = m.ID + " " + m.Filename
+	}
+	return nil, fmt.Errorf("'%s' matches %d sessions, use the ID:\n  %s", ref, len(matches), strings.Join(ids, "\n  "))
+}
+
+// FileStore keeps one JSON file per session, ongoing and completed
+// sessions live in separate directories.
+type FileStore struct {
+	OngoingDir  string
+	CompleteDir string
+	// HostsFile keeps the HostProfiles, none are kept if it is empty
+	HostsFile string
+}
+
+// NewFileStore returns a store in the default config directories.
+func NewFileStore() *FileStore {
+	return &FileStore{
+		OngoingDir:  util.GetOngoingDir(),
+		CompleteDir: util.GetCompleteDir(),
+		HostsFile:   filepath.Join(util.GetConfigDir(), "hosts.json"),
+	}
+}
+
+func (s *FileStore) path(dir, id string) string {
+	return filepath.Join(dir, filepath.Base(id))
+}
+
+func (s *FileStore) Load(id string) (*DownloadState, error) {
+	return LoadState(s.path(s.OngoingDir, id))
+}
+
+func (s *FileStore) Save(state *DownloadState) error {
+	return SaveState(s.path(s.OngoingDir, state.ID), state)
+}
+
+func (s *FileStore) Complete(state *DownloadState) error {
+	src := s.path(s.OngoingDir, state.ID) + ".json"
+	dst := s.path(s.CompleteDir, state.ID) + ".json"
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	syncDir(s.CompleteDir)
+	syncDir(s.OngoingDir)
+	return nil
+}
+
+func (s *FileStore) Delete(id string) error {
+	for _, dir := range []string{s.OngoingDir, s.CompleteDir} {
+		err := os.Remove(s.path(dir, id) + ".json")
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// List loads every session in the ongoing or complete dir.
+func (s *FileStore) List(complete bool) ([]*DownloadState, []*SessionError) {
+	dir := s.OngoingDir
+	if complete {
+		dir = s.CompleteDir
+	}
+	return loadSessionsFromDir(dir)
+}
+
+func loadSessionsFromDir(dir string) ([]*DownloadState, []*SessionError) {
+	var sessions []*DownloadState
+	var broken []*SessionError
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return sessions, broken
+	}
+
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == ".json" {
+			baseName := file.Name()[:len(file.Name())-5]
+			path := filepath.Join(dir, baseName)
+			state, err := LoadState(path)
+			if err != nil {
+				broken = append(broken, &SessionError{ID: baseName, Err: err})
+				continue
+			}
+			sessions = append(sessions, state)
+		}
+	}
+
+	return sessions, broken
+}
+
+func SaveState(filename string, state *DownloadState) error {
+	state.Version = StateVersion
+	state.Updated = time.Now()
+	//conv struct to json format
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename+".json", data)
+}
+
+// writeFileAtomic replaces path through a synced temp file and a rename,
+// so a crash leaves either the old or the new content, never a mix.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	// only does something if we fail before the rename
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir makes a rename in dir durable. Not every platform can sync a
+// directory, so errors are ignored.
+func syncDir(dir string) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	f.Sync()
+	f.Close()
+}
+
+func LoadState(filename string) (*DownloadState, error) {
+	data, err := os.ReadFile(filename + ".json")
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeState(data, filename)
+}
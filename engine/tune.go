@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/anuraggr/adam/util"
+)
+
+const (
+	// autoStartWorkers is where AutoWorkers begins
+	autoStartWorkers = 2
+	// DefaultWorkerLimit is the ceiling of AutoWorkers when none is set
+	DefaultWorkerLimit = 16
+	// tuneSamples speed samples, half a second each, make a measurement
+	tuneSamples = 4
+	// tuneGain is how much a measurement must beat the best one to
+	// count as an improvement
+	tuneGain = 1.1
+)
+
+// tuner grows the worker pool of an AutoWorkers download while the
+// throughput keeps improving. It is fed by the speed goroutine.
+type tuner struct {
+	d       *Downloader
+	ceiling int
+
+	mu      sync.Mutex
+	samples []float64
+	best    float64
+	// step is how many workers the last measurement added
+	step int
+	// settled is set once more workers stopped helping or the server
+	// pushed back, the pool does not grow after that
+	settled bool
+}
+
+func newTuner(d *Downloader) *tuner {
+	ceiling := d.opts.WorkerLimit
+	if ceiling == 0 {
+		ceiling = DefaultWorkerLimit
+	}
+	return &tuner{d: d, ceiling: d.capWorkers(ceiling)}
+}
+
+func (t *tuner) sample(speed float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.samples = append(t.samples, speed)
+	if len(t.samples) < tuneSamples || t.settled {
+		return
+	}
+	var sum float64
+	for _, s := range t.samples {
+		sum += s
+	}
+	measured := sum / float64(len(t.samples))
+	t.samples = t.samples[:0]
+
+	workers := t.d.pool.getLimit()
+	if t.best > 0 && measured < t.best*tuneGain {
+		// the last workers did not pay off, give them back
+		t.settled = true
+		if t.step > 0 {
+			t.d.setWorkers(workers - t.step)
+			t.d.emit(WorkersEvent{Workers: workers - t.step, Reason: fmt.Sprintf("%s did not beat %s", util.FormatSpeed(measured), util.FormatSpeed(t.best))})
+		}
+		return
+	}
+
+	t.best = measured
+	// grow by half, quick on fast links without overshooting by much
+	want := min(workers+max(workers/2, 1), t.ceiling)
+	got := workers
+	if want > workers {
+		got = t.d.setWorkers(want)
+	}
+	if got <= workers {
+		// at the ceiling or nothing left worth splitting
+		t.settled = true
+		return
+	}
+	// got, not want: the revert has to land back on workers
+	t.step = got - workers
+	t.d.emit(WorkersEvent{Workers: got, Reason: fmt.Sprintf("%s with %d workers", util.FormatSpeed(measured), workers)})
+}
+
+// throttled stops the growth, the server wants fewer connections.
+func (t *tuner) throttled() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.settled = true
+}
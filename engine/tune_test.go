@@ -0,0 +1,99 @@
+package engine
+
+import (
+	"fmt"
+	"testing"
+)
+
+// newTestTuner returns a tuner over a downloader with running workers
+// and nothing to split, so setWorkers starts at most running of them.
+func newTestTuner(t *testing.T, running int) (*tuner, *recorder) {
+	rec := &recorder{}
+	opts := testOptions(t, rec)
+	opts.AutoWorkers = true
+	opts.WorkerLimit = 8
+	d := newDownloader(&DownloadState{URL: "http://example.com/file.bin"}, opts, nil, nil)
+	d.pool = newWorkerPool(autoStartWorkers)
+	d.outstanding = running
+	return newTuner(d), rec
+}
+
+// measure feeds the tuner one measurement of speed.
+func measure(tu *tuner, speed float64) {
+	for range tuneSamples {
+		tu.sample(speed)
+	}
+}
+
+func workerCounts(rec *recorder) string {
+	var counts []int
+	for _, w := range rec.workers() {
+		counts = append(counts, w.Workers)
+	}
+	return fmt.Sprint(counts)
+}
+
+func TestTunerGrowsWhileSpeedRises(t *testing.T) {
+	tu, rec := newTestTuner(t, MaxWorkers)
+	for _, speed := range []float64{1e6, 2e6, 3e6} {
+		measure(tu, speed)
+	}
+	if got := tu.d.pool.getLimit(); got != 6 {
+		t.Fatalf("limit %d after three faster measurements, want 6", got)
+	}
+
+	// the last two workers did not pay off, they go again
+	measure(tu, 3.1e6)
+	if got := tu.d.pool.getLimit(); got != 4 {
+		t.Errorf("limit %d after a flat measurement, want 4", got)
+	}
+	measure(tu, 10e6)
+	if got := tu.d.pool.getLimit(); got != 4 {
+		t.Errorf("limit %d after settling, want it to stay at 4", got)
+	}
+	if got := workerCounts(rec); got != "[3 4 6 4]" {
+		t.Errorf("workers went %s, want [3 4 6 4]", got)
+	}
+}
+
+func TestTunerStopsAtCeiling(t *testing.T) {
+	tu, rec := newTestTuner(t, MaxWorkers)
+	for speed := 1e6; speed <= 8e6; speed += 1e6 {
+		measure(tu, speed)
+	}
+	if got := tu.d.pool.getLimit(); got != 8 {
+		t.Errorf("limit %d, want the ceiling of 8", got)
+	}
+	if got := workerCounts(rec); got != "[3 4 6 8]" {
+		t.Errorf("workers went %s, want [3 4 6 8]", got)
+	}
+}
+
+func TestTunerSettlesWhenThrottled(t *testing.T) {
+	tu, _ := newTestTuner(t, MaxWorkers)
+	measure(tu, 1e6)
+	tu.throttled()
+	measure(tu, 2e6)
+	measure(tu, 3e6)
+	if got := tu.d.pool.getLimit(); got != 3 {
+		t.Errorf("limit %d after the server pushed back, want 3", got)
+	}
+}
+
+func TestSetWorkersKeepsLimitAtWhatRuns(t *testing.T) {
+	tu, _ := newTestTuner(t, 3)
+	d := tu.d
+	if got := d.setWorkers(6); got != 3 {
+		t.Fatalf("setWorkers(6) = %d with 3 running and nothing to split, want 3", got)
+	}
+	if got := d.pool.getLimit(); got != 3 {
+		t.Errorf("limit %d, want the 3 that run", got)
+	}
+
+	// growth ends where no more workers start
+	measure(tu, 1e6)
+	measure(tu, 2e6)
+	if got := d.pool.getLimit(); got != 3 || !tu.settled {
+		t.Errorf("limit %d, settled %v, want 3 and settled", got, tu.settled)
+	}
+}
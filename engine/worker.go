@@ -0,0 +1,339 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var ErrLinkExpired = errors.New("link expired")
+var ErrWorkerCancelled = errors.New("worker cancelled")
+
+// errYield stops a worker that runs above a lowered pool limit. Its
+// part waits for a slot like the others.
+var errYield = errors.New("worker yields its slot")
+
+// throttledError is returned when the server answers 429 or 503, or
+// resets a range request. It asks for fewer connections, not for the
+// same request again.
+type throttledError struct {
+	status string
+	// retryAfter is the server's Retry-After, zero if it sent none
+	retryAfter time.Duration
+}
+
+func (e *throttledError) Error() string {
+	return "server is throttling: " + e.status
+}
+
+// retryAfter reads a Retry-After header given in seconds or as a date.
+func retryAfter(h http.Header) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// partSyncInterval is how often a worker flushes its part file to disk
+// and publishes the new offset for the next state save.
+const partSyncInterval = time.Second
+
+func (d *Downloader) tryDownload(ctx context.Context, part *Part) error {
+	filename := partFileName(d.state.Filename, part.ID)
+	maxRetries := d.opts.MaxRetries
+
+	offset, _ := d.partStatus(part)
+	d.emit(PartEvent{Kind: PartStarted, ID: part.ID, Start: part.Start, End: d.partEnd(part), Offset: offset})
+
+	var err error
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		before, _ := d.partStatus(part)
+		err = d.downloadChunk(ctx, part, filename)
+		if err == nil {
+			return nil
+		}
+
+		// a server over its connection limit may just hang up on the
+		// extra ones instead of answering 503. Learning a limit takes
+		// repeated pushback, one reset alone is not remembered.
+		if errors.Is(err, syscall.ECONNRESET) && d.state.TotalSize > 0 && d.pool.getLimit() > 1 {
+			err = &throttledError{status: "connection reset"}
+		}
+
+		// don't retry if link expired or context cancelled, throttling
+		// is up to the caller
+		var throttled *throttledError
+		if errors.Is(err, ErrLinkExpired) || errors.Is(err, ErrWorkerCancelled) || errors.Is(err, errYield) || errors.As(err, &throttled) {
+			return err
+		}
+
+		// a connection that went quiet after making progress is picked
+		// up again from the offset without using up an attempt
+		after, _ := d.partStatus(part)
+		free := errors.Is(err, errStalled) && after > before
+
+		if attempt < maxRetries || free {
+			d.partMu.Lock()
+			part.RetryCount++
+			d.partMu.Unlock()
+			d.emit(PartEvent{Kind: PartRetried, ID: part.ID, Offset: after, Attempt: attempt, Err: err})
+			time.Sleep(1 * time.Second) // backoff
+		}
+		if free {
+			attempt--
+		}
+	}
+
+	return fmt.Errorf("worker %d failed after %d retries: %w", part.ID, maxRetries, err)
+}
+
+func partFileName(baseFilename string, id int) string {
+	return fmt.Sprintf("%s.part_%d.tmp", baseFilename, id)
+}
+
+// newRequest builds a GET request carrying the user agent and any
+// extra headers stored with the session ("Name: value" form).
+func newRequest(ctx context.Context, url string, headers []string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Adam/1.0")
+	for _, h := range headers {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			continue
+		}
+		req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	return req, nil
+}
+
+// claim takes up to n freshly read bytes for part and returns how many
+// of them are still inside it. The end of a part moves down when
+// another worker steals its tail.
+func (d *Downloader) claim(part *Part, n int) int {
+	d.partMu.Lock()
+	defer d.partMu.Unlock()
+	left := part.End - part.Start + 1 - part.written
+	// without a known size the part runs to the end of the body
+	if d.state.TotalSize > 0 && int64(n) > left {
+		n = int(max(left, 0))
+	}
+	part.written += int64(n)
+	return n
+}
+
+func (d *Downloader) partEnd(part *Part) int64 {
+	d.partMu.Lock()
+	defer d.partMu.Unlock()
+	return part.End
+}
+
+func (d *Downloader) downloadChunk(ctx context.Context, part *Part, filename string) error {
+	// without saved progress anything in the file is unsynced bytes
+	// of an earlier run, maybe from before the part was cut shorter
+	mode := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	startByte := part.Start
+	end := d.partEnd(part)
+	// a server without range support can only send the whole body, a
+	// part of unknown size is never resumed and never done before EOF
+	sized := d.state.TotalSize > 0 && end >= 0
+	if !sized && part.CurrentOffset > 0 {
+		d.setOffset(part, 0)
+	}
+
+	// we resume from current offset if we have progress
+	if sized && part.CurrentOffset > 0 {
+		expectedSize := part.CurrentOffset
+		info, err := os.Stat(filename)
+
+		// check if temp matches expected progress
+		if err == nil && info.Size() >= expectedSize {
+			if part.CurrentOffset >= (end - part.Start + 1) {
+				d.markComplete(part)
+				return nil
+			}
+
+			// bytes past the saved offset were never synced, drop them
+			if info.Size() > expectedSize {
+				if truncErr := os.Truncate(filename, expectedSize); truncErr != nil {
+					d.setOffset(part, 0)
+					mode = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+				} else {
+					startByte = part.Start + part.CurrentOffset
+					mode = os.O_APPEND | os.O_WRONLY
+				}
+			} else {
+				startByte = part.Start + part.CurrentOffset
+				mode = os.O_APPEND | os.O_WRONLY
+			}
+		} else {
+			// start fresh, temp doesn't match expected progress
+			d.setOffset(part, 0)
+			mode = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		}
+	}
+
+	// the idle timer cancels only this request, a stall is retried
+	reqCtx, cancelReq := context.WithCancel(ctx)
+	defer cancelReq()
+	reqCtx, connDone := d.conns.trace(reqCtx)
+	defer connDone()
+	// the slow worker check blames the link of this connection
+	reqCtx = httptrace.WithClientTrace(reqCtx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			d.partMu.Lock()
+			part.conn = info.Conn
+			d.partMu.Unlock()
+		},
+	})
+	idle := newIdleTimer(orDefault(d.opts.IdleTimeout, DefaultIdleTimeout), cancelReq)
+	defer idle.stop()
+
+	req, err := newRequest(reqCtx, d.state.URL, d.state.Headers)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	// nothing written past here survives a restart
+	d.partMu.Lock()
+	part.written = part.CurrentOffset
+	d.partMu.Unlock()
+
+	if sized {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", startByte, end))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ErrWorkerCancelled
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	d.conns.setProto(resp.Proto)
+	d.partMu.Lock()
+	part.Protocol = resp.Proto
+	d.partMu.Unlock()
+
+	if resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("%w: update download link with 'adam update'", ErrLinkExpired)
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		return &throttledError{status: resp.Status, retryAfter: retryAfter(resp.Header)}
+	}
+
+	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned unexpected status: %s", resp.Status)
+	}
+	// the whole body written at this offset would corrupt the file
+	if resp.StatusCode == http.StatusOK && startByte > 0 {
+		return fmt.Errorf("server ignored the range request for bytes %d-%d", startByte, end)
+	}
+
+	file, err := os.OpenFile(filename, mode, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// offset counts what is written, part.CurrentOffset only follows it
+	// after a sync so a saved state never claims bytes a crash can lose
+	offset := part.CurrentOffset
+	d.tracker.update(part.ID, offset)
+	lastSync := time.Now()
+	defer func() {
+		if file.Sync() == nil {
+			d.setOffset(part, offset)
+		}
+	}()
+
+	//Increased buffer size from 32kb to 128kb to
+	//decrease the number of syscalls
+	buf := make([]byte, 128*1024) // 128kb buffer
+
+	for {
+		// check if cancelled
+		select {
+		case <-ctx.Done():
+			return ErrWorkerCancelled
+		default:
+		}
+
+		// we have to check if paused before each read
+		d.tracker.waitIfPaused(ctx)
+
+		idle.start()
+		n, readErr := resp.Body.Read(buf[:d.limiter.readSize(len(buf))])
+		idle.stop()
+		if kept := d.claim(part, n); kept < n {
+			// the tail went to another part, we are done
+			n = kept
+			readErr = io.EOF
+		}
+		if n > 0 {
+			_, writeErr := file.Write(buf[:n])
+			if writeErr != nil {
+				return writeErr
+			}
+			offset += int64(n)
+
+			d.tracker.update(part.ID, offset)
+
+			if time.Since(lastSync) >= partSyncInterval {
+				if err := file.Sync(); err != nil {
+					return err
+				}
+				d.setOffset(part, offset)
+				lastSync = time.Now()
+
+				// fewer workers were asked for, make way at a point
+				// where nothing is lost
+				if d.pool.over() {
+					return errYield
+				}
+			}
+
+			if d.limiter.wait(ctx, n) != nil {
+				return ErrWorkerCancelled
+			}
+		}
+
+		if readErr == io.EOF {
+			if err := file.Sync(); err != nil {
+				return err
+			}
+			d.setOffset(part, offset)
+			d.markComplete(part)
+			break
+		}
+		if readErr != nil {
+			if ctx.Err() != nil {
+				return ErrWorkerCancelled
+			}
+			if idle.stalled() {
+				return errStalled
+			}
+			return readErr
+		}
+	}
+
+	return nil
+}
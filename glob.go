@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxGlobExpansion guards against patterns like [1-99999999].
+const maxGlobExpansion = 100000
+
+var ErrNoGlob = errors.New("url has no glob pattern")
+
+// globMatch is one expanded url plus the text each pattern matched, so
+// that output templates can refer to them as #1, #2 ...
+type globMatch struct {
+	URL     string
+	Matched []string
+}
+
+// globSegment is either literal text (alternatives == nil) or a set of
+// alternatives coming from a [range] or {list}.
+type globSegment struct {
+	literal      string
+	alternatives []string
+}
+
+// expandGlob expands curl style patterns: {a,b,c} lists and [1-10],
+// [001-120], [a-z] ranges with an optional :step. A backslash escapes
+// the next character.
+func expandGlob(pattern string) ([]globMatch, error) {
+	segments, err := parseGlob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	total := 1
+	globs := 0
+	for _, seg := range segments {
+		if seg.alternatives == nil {
+			continue
+		}
+		globs++
+		total *= len(seg.alternatives)
+		if total > maxGlobExpansion {
+			return nil, fmt.Errorf("pattern expands to more than %d urls", maxGlobExpansion)
+		}
+	}
+	if globs == 0 {
+		return nil, ErrNoGlob
+	}
+
+	matches := []globMatch{{}}
+	for _, seg := range segments {
+		if seg.alternatives == nil {
+			for i := range matches {
+				matches[i].URL += seg.literal
+			}
+			continue
+		}
+
+		next := make([]globMatch, 0, len(matches)*len(seg.alternatives))
+		for _, m := range matches {
+			for _, alt := range seg.alternatives {
+				matched := make([]string, len(m.Matched), len(m.Matched)+1)
+				copy(matched, m.Matched)
+				next = append(next, globMatch{
+					URL:     m.URL + alt,
+					Matched: append(matched, alt),
+				})
+			}
+		}
+		matches = next
+	}
+
+	return matches, nil
+}
+
+func parseGlob(pattern string) ([]globSegment, error) {
+	var segments []globSegment
+	var literal strings.Builder
+
+	flush := func() {
+		if literal.Len() > 0 {
+			segments = append(segments, globSegment{literal: literal.String()})
+			literal.Reset()
+		}
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				literal.WriteByte(pattern[i])
+			}
+		case '{':
+			end := strings.IndexByte(pattern[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unmatched '{' at position %d", i)
+			}
+			flush()
+			segments = append(segments, globSegment{alternatives: strings.Split(pattern[i+1:i+end], ",")})
+			i += end
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unmatched '[' at position %d", i)
+			}
+			alts, err := expandRange(pattern[i+1 : i+end])
+			if err != nil {
+				return nil, fmt.Errorf("%v (use -g to turn off url globbing)", err)
+			}
+			flush()
+			segments = append(segments, globSegment{alternatives: alts})
+			i += end
+		default:
+			literal.WriteByte(c)
+		}
+	}
+	flush()
+
+	return segments, nil
+}
+
+// expandRange handles the inside of a [..] pattern.
+func expandRange(spec string) ([]string, error) {
+	step := 1
+	if body, stepStr, ok := strings.Cut(spec, ":"); ok {
+		n, err := strconv.Atoi(stepStr)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid step in range [%s]", spec)
+		}
+		spec, step = body, n
+	}
+
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok || from == "" || to == "" {
+		return nil, fmt.Errorf("invalid range [%s]", spec)
+	}
+
+	// letter ranges, [a-z] or [A-Z]
+	if len(from) == 1 && len(to) == 1 && !isDigit(from[0]) && !isDigit(to[0]) {
+		if from[0] > to[0] {
+			return nil, fmt.Errorf("invalid range [%s]", spec)
+		}
+		var out []string
+		for c := int(from[0]); c <= int(to[0]); c += step {
+			out = append(out, string(rune(c)))
+		}
+		return out, nil
+	}
+
+	start, err1 := strconv.Atoi(from)
+	end, err2 := strconv.Atoi(to)
+	if err1 != nil || err2 != nil || start > end || start < 0 {
+		return nil, fmt.Errorf("invalid range [%s]", spec)
+	}
+	if (end-start)/step+1 > maxGlobExpansion {
+		return nil, fmt.Errorf("range [%s] is too large", spec)
+	}
+
+	// a leading zero means fixed width, like curl
+	width := 0
+	if len(from) > 1 && from[0] == '0' {
+		width = len(from)
+	}
+
+	var out []string
+	for n := start; n <= end; n += step {
+		out = append(out, fmt.Sprintf("%0*d", width, n))
+	}
+	return out, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// applyTemplate replaces #N in an output name with the text matched by
+// the Nth pattern of the url.
+func applyTemplate(template string, matched []string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(template); i++ {
+		if template[i] != '#' || i+1 >= len(template) || !isDigit(template[i+1]) {
+			b.WriteByte(template[i])
+			continue
+		}
+
+		j := i + 1
+		for j < len(template) && isDigit(template[j]) {
+			j++
+		}
+		n, _ := strconv.Atoi(template[i+1 : j])
+		if n < 1 || n > len(matched) {
+			return "", fmt.Errorf("output template refers to #%d but url has %d patterns", n, len(matched))
+		}
+		b.WriteString(matched[n-1])
+		i = j - 1
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestExpandRange(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+		err  bool
+	}{
+		{spec: "1-3", want: "[1 2 3]"},
+		{spec: "08-11", want: "[08 09 10 11]"},
+		{spec: "001-120:50", want: "[001 051 101]"},
+		{spec: "a-e:2", want: "[a c e]"},
+		{spec: "X-Z", want: "[X Y Z]"},
+		{spec: "3-1", err: true},
+		{spec: "z-a", err: true},
+		{spec: "1-", err: true},
+		{spec: "1-5:0", err: true},
+		{spec: "a-9", err: true},
+		{spec: "0-100000", err: true},
+	}
+	for _, tt := range tests {
+		got, err := expandRange(tt.spec)
+		if tt.err {
+			if err == nil {
+				t.Errorf("expandRange(%q) = %v, want an error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprint(got) != tt.want {
+			t.Errorf("expandRange(%q) = %v, %v, want %s", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+func TestExpandGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		urls    string
+		matched string
+	}{
+		{
+			pattern: "http://x/{a,b}/[1-2].jpg",
+			urls:    "http://x/a/1.jpg http://x/a/2.jpg http://x/b/1.jpg http://x/b/2.jpg",
+			matched: "[[a 1] [a 2] [b 1] [b 2]]",
+		},
+		{
+			pattern: "http://x/img[09-10].png",
+			urls:    "http://x/img09.png http://x/img10.png",
+			matched: "[[09] [10]]",
+		},
+		{
+			// escaped brackets are literal, only the braces expand
+			pattern: `http://x/\[v\]{1,2}`,
+			urls:    "http://x/[v]1 http://x/[v]2",
+			matched: "[[1] [2]]",
+		},
+	}
+	for _, tt := range tests {
+		matches, err := expandGlob(tt.pattern)
+		if err != nil {
+			t.Errorf("expandGlob(%q): %v", tt.pattern, err)
+			continue
+		}
+		var urls []string
+		var matched [][]string
+		for _, m := range matches {
+			urls = append(urls, m.URL)
+			matched = append(matched, m.Matched)
+		}
+		if strings.Join(urls, " ") != tt.urls || fmt.Sprint(matched) != tt.matched {
+			t.Errorf("expandGlob(%q) = %v %v, want %s %s", tt.pattern, urls, matched, tt.urls, tt.matched)
+		}
+	}
+}
+
+func TestExpandGlobErrors(t *testing.T) {
+	if _, err := expandGlob(`http://x/\[1-2\].jpg`); !errors.Is(err, ErrNoGlob) {
+		t.Errorf("escaped pattern: %v, want ErrNoGlob", err)
+	}
+	if _, err := expandGlob("http://x/plain.jpg"); !errors.Is(err, ErrNoGlob) {
+		t.Errorf("plain url: %v, want ErrNoGlob", err)
+	}
+	for _, pattern := range []string{"http://x/{a,b", "http://x/[1-2", "http://x/[2-1]"} {
+		if _, err := expandGlob(pattern); err == nil || errors.Is(err, ErrNoGlob) {
+			t.Errorf("expandGlob(%q) = %v, want a pattern error", pattern, err)
+		}
+	}
+	// each range is fine on its own, together they are too many
+	_, err := expandGlob("http://x/[1-1000]/[1-1000]")
+	if err == nil || !strings.Contains(err.Error(), "more than") {
+		t.Errorf("huge expansion: %v", err)
+	}
+}
+
+func TestApplyTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+		err      bool
+	}{
+		{template: "#2-#1.jpg", want: "01-cat.jpg"},
+		{template: "issue#.txt", want: "issue#.txt"},
+		{template: "#1#2", want: "cat01"},
+		{template: "#3.jpg", err: true},
+		{template: "#0.jpg", err: true},
+	}
+	for _, tt := range tests {
+		got, err := applyTemplate(tt.template, []string{"cat", "01"})
+		if tt.err {
+			if err == nil {
+				t.Errorf("applyTemplate(%q) = %q, want an error", tt.template, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("applyTemplate(%q) = %q, %v, want %q", tt.template, got, err, tt.want)
+		}
+	}
+}
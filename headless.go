@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/anuraggr/adam/engine"
+	"github.com/anuraggr/adam/util"
+
+	"github.com/mattn/go-isatty"
+)
+
+// headlessInterval is how often a progress line is printed when there
+// is no TUI. Every update is its own line so it reads well in logs.
+const headlessInterval = 5 * time.Second
+
+var ErrInterrupted = errors.New("interrupted")
+
+// reporter turns engine events into output when there is no TUI.
+type reporter interface {
+	Handle(e engine.Event)
+	Finish(err error, code int)
+}
+
+func stdoutIsTerminal() bool {
+	fd := os.Stdout.Fd()
+	return isatty.IsTerminal(fd) || isatty.IsCygwinTerminal(fd)
+}
+
+// runHeadless downloads without bubbletea and returns the exit code.
+// SIGINT and SIGTERM stop the workers and leave a resumable session.
+func runHeadless(d *engine.Downloader, r reporter) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	code, err := runResult(ctx, d.Run(ctx))
+	r.Finish(err, code)
+	return code
+}
+
+// runResult turns what Run returned into the exit code and the error
+// to report.
+func runResult(ctx context.Context, err error) (int, error) {
+	switch {
+	case ctx.Err() != nil:
+		return exitInterrupted, ErrInterrupted
+	case errors.Is(err, engine.ErrLinkExpired):
+		return exitLinkExpired, err
+	case err != nil:
+		return exitFailure, err
+	}
+	return exitOK, nil
+}
+
+// plainReporter prints human readable progress lines.
+type plainReporter struct {
+	mu        sync.Mutex
+	out       io.Writer
+	id        string
+	filename  string
+	total     int64
+	startTime time.Time
+	lastPrint time.Time
+}
+
+func newPlainReporter(out io.Writer) *plainReporter {
+	return &plainReporter{out: out, startTime: time.Now(), lastPrint: time.Now()}
+}
+
+func (p *plainReporter) Handle(e engine.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch msg := e.(type) {
+	case engine.ProbeEvent:
+		if !msg.RangeSupport {
+			fmt.Fprintln(p.out, "Server does not support range requests. Falling back to a single worker.")
+		}
+		if strings.HasPrefix(msg.Protocol, "HTTP/2") {
+			fmt.Fprintln(p.out, "Server speaks HTTP/2, the workers share one connection. Use --http1 to give each its own.")
+		}
+	case engine.StartEvent:
+		p.id = msg.ID
+		p.filename = msg.Filename
+		p.total = msg.TotalSize
+	case engine.WorkersEvent:
+		fmt.Fprintf(p.out, "Workers: %d (%s)\n", msg.Workers, msg.Reason)
+	case engine.SpeedEvent:
+		if time.Since(p.lastPrint) < headlessInterval {
+			return
+		}
+		p.lastPrint = time.Now()
+		fmt.Fprintln(p.out, formatProgressLine(p.total, msg.Received, msg.BytesPerSec, msg.TimeRemaining))
+	}
+}
+
+func (p *plainReporter) Finish(err error, code int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch {
+	case errors.Is(err, ErrInterrupted):
+		fmt.Fprintf(p.out, "Interrupted. Resume with: adam resume %s\n", p.id)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		if p.id != "" {
+			fmt.Fprintf(os.Stderr, "Progress saved. Resume with: adam resume %s\n", p.id)
+		}
+	default:
+		elapsed := time.Since(p.startTime)
+		avg := float64(p.total) / elapsed.Seconds()
+		fmt.Fprintf(p.out, "Done: %s (%s in %s, avg %s)\n",
+			p.filename,
+			util.FormatBytes(p.total),
+			elapsed.Round(time.Second),
+			util.FormatSpeed(avg),
+		)
+	}
+}
+
+func formatProgressLine(total, received int64, speed float64, remaining time.Duration) string {
+	if total <= 0 {
+		return fmt.Sprintf("%s | %s", util.FormatBytes(received), util.FormatSpeed(speed))
+	}
+
+	eta := "--:--"
+	if remaining > 0 {
+		eta = remaining.Round(time.Second).String()
+	}
+	return fmt.Sprintf("%5.1f%% | %s / %s | %s | ETA %s",
+		float64(received)/float64(total)*100,
+		util.FormatBytes(received),
+		util.FormatBytes(total),
+		util.FormatSpeed(speed),
+		eta,
+	)
+}
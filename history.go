@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anuraggr/adam/engine"
+	"github.com/anuraggr/adam/util"
+)
+
+// historyRecord is one finished download as 'adam history' reports and
+// exports it.
+type historyRecord struct {
+	ID        string             `json:"id"`
+	Name      string             `json:"name"`
+	Path      string             `json:"path"`
+	URL       string             `json:"url"`
+	Host      string             `json:"host"`
+	Group     string             `json:"group,omitempty"`
+	Size      int64              `json:"size"`
+	Started   time.Time          `json:"started"`
+	Completed time.Time          `json:"completed"`
+	Duration  float64            `json:"duration_seconds"`
+	AvgSpeed  float64            `json:"avg_speed"`
+	PeakSpeed float64            `json:"peak_speed"`
+	Checksum  string             `json:"checksum,omitempty"`
+	Digest    string             `json:"digest,omitempty"`
+	Retries   int                `json:"retries"`
+	Restarts  int                `json:"restarts"`
+	Parts     []historyPart      `json:"parts"`
+	Server    *engine.ServerInfo `json:"server,omitempty"`
+}
+
+type historyPart struct {
+	ID       int   `json:"id"`
+	Size     int64 `json:"size"`
+	Retries  int   `json:"retries"`
+	Restarts int   `json:"restarts"`
+}
+
+// historyQuery selects and orders history records.
+type historyQuery struct {
+	text    string
+	host    string
+	since   time.Time
+	until   time.Time
+	sortBy  string
+	reverse bool
+	limit   int
+}
+
+// urlHost returns the host name of a download url, or "" if it has none.
+func urlHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// hostMatches reports whether host is want or one of its subdomains.
+func hostMatches(host, want string) bool {
+	host = strings.ToLower(host)
+	want = strings.ToLower(want)
+	return host == want || strings.HasSuffix(host, "."+want)
+}
+
+func newHistoryRecord(state *engine.DownloadState) historyRecord {
+	r := historyRecord{
+		ID:        state.ID,
+		Name:      filepath.Base(state.Filename),
+		Path:      state.Filename,
+		URL:       state.URL,
+		Host:      urlHost(state.URL),
+		Group:     groupName(state),
+		Size:      state.TotalSize,
+		Started:   state.Created,
+		Completed: state.Completed,
+		Duration:  state.Elapsed.Seconds(),
+		PeakSpeed: state.PeakSpeed,
+		Checksum:  state.Checksum,
+		Digest:    state.Digest,
+		Server:    state.Server,
+		Parts:     make([]historyPart, len(state.Parts)),
+	}
+	if r.Duration > 0 {
+		r.AvgSpeed = float64(r.Size) / r.Duration
+	}
+	for i, p := range state.Parts {
+		r.Parts[i] = historyPart{ID: p.ID, Size: p.End - p.Start + 1, Retries: p.RetryCount, Restarts: p.RestartCount}
+		r.Retries += p.RetryCount
+		r.Restarts += p.RestartCount
+	}
+	return r
+}
+
+// parseWhen reads a date ("2006-01-02", optionally with a time) or an
+// age such as "7d" counted back from now. A date without a time is its
+// start, or with endOfDay its last moment, so that --until 2026-10-18
+// takes in that day.
+func parseWhen(s string, endOfDay bool) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		if endOfDay {
+			return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+		}
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	age, err := util.ParseAge(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, expected 2006-01-02 or an age like 7d", s)
+	}
+	return time.Now().Add(-age), nil
+}
+
+func (q historyQuery) match(r historyRecord) bool {
+	if q.text != "" {
+		text := strings.ToLower(q.text)
+		if !strings.Contains(strings.ToLower(r.Name), text) && !strings.Contains(strings.ToLower(r.URL), text) {
+			return false
+		}
+	}
+	if q.host != "" && !hostMatches(r.Host, q.host) {
+		return false
+	}
+	if !q.since.IsZero() && r.Completed.Before(q.since) {
+		return false
+	}
+	if !q.until.IsZero() && r.Completed.After(q.until) {
+		return false
+	}
+	return true
+}
+
+var historySorts = map[string]func(a, b historyRecord) bool{
+	// newest first, which is what people look for
+	"date":     func(a, b historyRecord) bool { return a.Completed.After(b.Completed) },
+	"name":     func(a, b historyRecord) bool { return strings.ToLower(a.Name) < strings.ToLower(b.Name) },
+	"host":     func(a, b historyRecord) bool { return a.Host < b.Host },
+	"size":     func(a, b historyRecord) bool { return a.Size > b.Size },
+	"duration": func(a, b historyRecord) bool { return a.Duration > b.Duration },
+	"speed":    func(a, b historyRecord) bool { return a.AvgSpeed > b.AvgSpeed },
+}
+
+func showHistory(q historyQuery, format string) int {
+	less, ok := historySorts[q.sortBy]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: unknown sort '%s', expected date, name, host, size, duration or speed\n", q.sortBy)
+		return exitUsage
+	}
+
+	sessions, _ := engine.NewFileStore().List(true)
+	var records []historyRecord
+	for _, state := range sessions {
+		r := newHistoryRecord(state)
+		if q.match(r) {
+			records = append(records, r)
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		if q.reverse {
+			return less(records[j], records[i])
+		}
+		return less(records[i], records[j])
+	})
+	if q.limit > 0 && len(records) > q.limit {
+		records = records[:q.limit]
+	}
+
+	switch format {
+	case "table":
+		printHistoryTable(os.Stdout, records)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if records == nil {
+			records = []historyRecord{}
+		}
+		enc.Encode(records)
+	case "csv":
+		if err := writeHistoryCSV(os.Stdout, records); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return exitFailure
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown format '%s', expected table, json or csv\n", format)
+		return exitUsage
+	}
+	return exitOK
+}
+
+func printHistoryTable(w io.Writer, records []historyRecord) {
+	if len(records) == 0 {
+		fmt.Fprintln(w, "No completed downloads found.")
+		return
+	}
+
+	fmt.Fprintf(w, "%-16s | %-8s | %-30s | %-10s | %-8s | %-10s | %s\n", "Completed", "ID", "File Name", "Size", "Time", "Avg", "Host")
+	fmt.Fprintln(w, strings.Repeat("-", 110))
+	for _, r := range records {
+		completed := "-"
+		if !r.Completed.IsZero() {
+			completed = r.Completed.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%-16s | %-8s | %-30s | %-10s | %-8s | %-10s | %s\n",
+			completed,
+			util.TruncateString(r.ID, 8),
+			util.TruncateString(r.Name, 30),
+			util.FormatBytes(r.Size),
+			(time.Duration(r.Duration) * time.Second).String(),
+			util.FormatSpeed(r.AvgSpeed),
+			r.Host,
+		)
+	}
+}
+
+func writeHistoryCSV(w io.Writer, records []historyRecord) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{
+		"id", "name", "path", "url", "host", "group", "size", "started", "completed",
+		"duration_seconds", "avg_speed", "peak_speed", "checksum", "digest",
+		"retries", "restarts", "content_type", "etag", "last_modified", "final_url",
+	})
+
+	formatStamp := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	for _, r := range records {
+		server := engine.ServerInfo{}
+		if r.Server != nil {
+			server = *r.Server
+		}
+		cw.Write([]string{
+			r.ID, r.Name, r.Path, r.URL, r.Host, r.Group,
+			strconv.FormatInt(r.Size, 10),
+			formatStamp(r.Started),
+			formatStamp(r.Completed),
+			strconv.FormatFloat(r.Duration, 'f', 1, 64),
+			strconv.FormatFloat(r.AvgSpeed, 'f', 0, 64),
+			strconv.FormatFloat(r.PeakSpeed, 'f', 0, 64),
+			r.Checksum, r.Digest,
+			strconv.Itoa(r.Retries),
+			strconv.Itoa(r.Restarts),
+			server.ContentType, server.ETag, server.LastModified, server.FinalURL,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/anuraggr/adam/engine"
+)
+
+// jsonReporter writes one JSON object per line for every engine event,
+// for programs that wrap adam. Every object has "time" and "event".
+type jsonReporter struct {
+	mu  *sync.Mutex
+	enc *json.Encoder
+	// file and session tell the downloads of a batch apart, session is
+	// known from the start event on
+	file    string
+	session string
+}
+
+func newJSONReporter(out io.Writer) *jsonReporter {
+	return &jsonReporter{mu: new(sync.Mutex), enc: json.NewEncoder(out)}
+}
+
+// entry returns a reporter for one download of a batch. It writes to
+// the same output and adds "file" and "session" to every object.
+func (j *jsonReporter) entry(filename string) *jsonReporter {
+	return &jsonReporter{mu: j.mu, enc: j.enc, file: filename}
+}
+
+func (j *jsonReporter) emit(event string, fields map[string]any) {
+	if fields == nil {
+		fields = make(map[string]any)
+	}
+	fields["event"] = event
+	fields["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file != "" {
+		fields["file"] = j.file
+	}
+	if j.session != "" {
+		fields["session"] = j.session
+	}
+	j.enc.Encode(fields)
+}
+
+func (j *jsonReporter) Handle(e engine.Event) {
+	switch msg := e.(type) {
+	case engine.ProbeEvent:
+		j.emit("probe", map[string]any{
+			"url":           msg.URL,
+			"total_size":    msg.TotalSize,
+			"range_support": msg.RangeSupport,
+			"protocol":      msg.Protocol,
+		})
+
+	case engine.StartEvent:
+		if j.file != "" {
+			j.mu.Lock()
+			j.session = msg.ID
+			j.mu.Unlock()
+		}
+		j.emit("start", map[string]any{
+			"url":        msg.URL,
+			"id":         msg.ID,
+			"filename":   msg.Filename,
+			"total_size": msg.TotalSize,
+			"parts":      msg.Parts,
+		})
+
+	case engine.PartEvent:
+		fields := map[string]any{
+			"part":   msg.ID,
+			"offset": msg.Offset,
+		}
+		switch msg.Kind {
+		case engine.PartStarted, engine.PartCompleted:
+			fields["start"] = msg.Start
+			fields["end"] = msg.End
+		case engine.PartRetried, engine.PartRestarted, engine.PartFailed:
+			fields["attempt"] = msg.Attempt
+		case engine.PartParked:
+			fields["attempt"] = msg.Attempt
+			fields["retry_in_seconds"] = msg.RetryIn.Seconds()
+		}
+		if msg.Err != nil {
+			fields["error"] = msg.Err.Error()
+		}
+		j.emit(string(msg.Kind), fields)
+		if errors.Is(msg.Err, engine.ErrLinkExpired) {
+			j.emit("link_expired", map[string]any{"part": msg.ID})
+		}
+
+	case engine.SpeedEvent:
+		j.emit("speed", map[string]any{
+			"bytes_per_sec": msg.BytesPerSec,
+			"received":      msg.Received,
+			"eta_seconds":   msg.TimeRemaining.Seconds(),
+		})
+
+	case engine.MergeEvent:
+		j.emit("merge", map[string]any{
+			"part":  msg.Part,
+			"total": msg.Total,
+		})
+
+	case engine.WorkersEvent:
+		j.emit("workers", map[string]any{
+			"workers": msg.Workers,
+			"reason":  msg.Reason,
+		})
+
+	case engine.DebugEvent:
+		j.emit("debug", map[string]any{"message": msg.Message})
+	}
+}
+
+func (j *jsonReporter) Finish(err error, code int) {
+	if err != nil {
+		j.emit("error", map[string]any{
+			"error":     err.Error(),
+			"exit_code": code,
+		})
+		return
+	}
+	j.emit("done", map[string]any{"exit_code": code})
+}
@@ -1,113 +1,447 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
 
-	"adam/util"
+	"github.com/anuraggr/adam/engine"
+	"github.com/anuraggr/adam/util"
 )
 
-func listSessions(filter string) {
-	var sessions []*DownloadState
-	var sources []string
+// Session statuses as 'adam ls' reports them.
+const (
+	statusPaused     = "paused"
+	statusActive     = "active"
+	statusFailed     = "failed"
+	statusExpired    = "expired"
+	statusComplete   = "complete"
+	statusUnreadable = "unreadable"
+)
+
+// listOptions selects, orders and formats the rows of 'adam ls'.
+type listOptions struct {
+	// filter is all, ongoing or complete
+	filter string
+	// patterns are globs matched against the file or group name
+	patterns []string
+	host     string
+	// sortBy is empty to keep the stored order, or name, size,
+	// progress or date
+	sortBy  string
+	reverse bool
+	// format is table, wide, json or a Go template run for every row
+	format string
+}
 
-	switch filter {
-	case "ongoing":
-		sources = []string{util.GetOngoingDir()}
-	case "complete":
-		sources = []string{util.GetCompleteDir()}
-	default: // "all"
-		sources = []string{util.GetOngoingDir(), util.GetCompleteDir()}
+func (o listOptions) match(state *engine.DownloadState) bool {
+	if o.host != "" && !hostMatches(urlHost(state.URL), o.host) {
+		return false
 	}
+	if len(o.patterns) == 0 {
+		return true
+	}
+	name := strings.ToLower(filepath.Base(state.Filename))
+	group := strings.ToLower(groupName(state))
+	for _, pattern := range o.patterns {
+		pattern = strings.ToLower(pattern)
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, group); ok && group != "" {
+			return true
+		}
+	}
+	return false
+}
 
-	for _, dir := range sources {
-		sessions = append(sessions, loadSessionsFromDir(dir)...)
+var listSorts = map[string]func(a, b *sessionRow) bool{
+	"name":     func(a, b *sessionRow) bool { return strings.ToLower(a.Name) < strings.ToLower(b.Name) },
+	"size":     func(a, b *sessionRow) bool { return a.Size > b.Size },
+	"progress": func(a, b *sessionRow) bool { return a.Progress > b.Progress },
+	// most recently touched first
+	"date": func(a, b *sessionRow) bool { return a.Updated.After(b.Updated) },
+}
+
+func listSessions(opts listOptions) int {
+	less, ok := listSorts[opts.sortBy]
+	if !ok && opts.sortBy != "" {
+		fmt.Fprintf(os.Stderr, "Error: unknown sort '%s', expected name, size, progress or date\n", opts.sortBy)
+		return exitUsage
 	}
 
-	if len(sessions) == 0 {
-		fmt.Println("No sessions found.")
-		return
+	var tmpl *template.Template
+	switch opts.format {
+	case "table", "wide", "json":
+	default:
+		var err error
+		tmpl, err = template.New("ls").Parse(opts.format)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error: invalid format:", err)
+			return exitUsage
+		}
 	}
 
-	fmt.Printf("%-3s | %-25s | %-10s | %-8s | %s\n", "ID", "File Name", "Size", "Progress", "Status")
-	fmt.Println(strings.Repeat("-", 80))
+	var sessions []*engine.DownloadState
+	var broken []*engine.SessionError
+	store := engine.NewFileStore()
+	complete := make(map[string]bool)
 
-	for i, state := range sessions {
-		var downloaded int64 = 0
-		for _, p := range state.Parts {
-			downloaded += p.CurrentOffset
+	add := func(list []*engine.DownloadState, errs []*engine.SessionError, done bool) {
+		for _, state := range list {
+			if opts.match(state) {
+				sessions = append(sessions, state)
+				complete[state.ID] = done
+			}
 		}
+		broken = append(broken, errs...)
+	}
+	if opts.filter != "complete" {
+		list, errs := store.List(false)
+		add(list, errs, false)
+	}
+	if opts.filter != "ongoing" {
+		list, errs := store.List(true)
+		add(list, errs, true)
+	}
+	// filtered listings are about sessions we can read
+	if len(opts.patterns) > 0 || opts.host != "" {
+		broken = nil
+	}
 
-		percent := 0.0
-		if state.TotalSize > 0 {
-			percent = float64(downloaded) / float64(state.TotalSize) * 100
-		}
+	active := func(id string) bool {
+		_, held := store.Holder(id)
+		return held
+	}
+	rows := groupSessions(sessions, func(id string) bool { return complete[id] }, active)
+	if less != nil {
+		sort.SliceStable(rows, func(i, j int) bool {
+			if opts.reverse {
+				return less(rows[j], rows[i])
+			}
+			return less(rows[i], rows[j])
+		})
+	}
+	// sessions we can't read are shown rather than hidden, so they
+	// don't look lost
+	for _, b := range broken {
+		rows = append(rows, &sessionRow{ID: b.ID, Name: "?", Size: -1, Progress: -1, Status: statusUnreadable, Error: b.Err.Error()})
+	}
 
-		status := fmt.Sprintf("%.1f%%", percent)
-		statusLabel := "Ongoing"
-		if percent >= 100 {
-			status = "Done"
-			statusLabel = "Complete"
+	switch {
+	case opts.format == "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if rows == nil {
+			rows = []*sessionRow{}
+		}
+		enc.Encode(rows)
+	case tmpl != nil:
+		for _, row := range rows {
+			if err := tmpl.Execute(os.Stdout, row); err != nil {
+				fmt.Fprintln(os.Stderr, "\nError:", err)
+				return exitUsage
+			}
+			fmt.Println()
 		}
+	case len(rows) == 0:
+		fmt.Println("No sessions found.")
+	case opts.format == "wide":
+		printWideList(os.Stdout, rows)
+	default:
+		printListTable(os.Stdout, rows)
+	}
+	return exitOK
+}
+
+func (r *sessionRow) sizeText() string {
+	if r.Size < 0 {
+		return "?"
+	}
+	return util.FormatBytes(r.Size)
+}
+
+func (r *sessionRow) progressText() string {
+	switch {
+	case r.Status == statusUnreadable:
+		return "?"
+	case r.Status == statusComplete:
+		return "Done"
+	case r.Progress < 0:
+		// without a size all we know is how much arrived
+		return util.FormatBytes(r.Downloaded)
+	}
+	return fmt.Sprintf("%.1f%%", r.Progress)
+}
+
+func (r *sessionRow) statusText() string {
+	label := strings.ToUpper(r.Status[:1]) + r.Status[1:]
+	if r.Files > 1 {
+		label = fmt.Sprintf("%s (%d/%d files)", label, r.FilesDone, r.Files)
+	}
+	return label
+}
 
-		fmt.Printf("%-3d | %-25s | %-10s | %-8s | %s\n",
-			i+1,
-			util.TruncateString(state.Filename, 25),
-			util.FormatBytes(state.TotalSize),
-			status,
-			statusLabel,
+func printListTable(w io.Writer, rows []*sessionRow) {
+	fmt.Fprintf(w, "%-8s | %-25s | %-10s | %-8s | %-20s | %s\n", "ID", "File Name", "Size", "Progress", "Status", "Host")
+	fmt.Fprintln(w, strings.Repeat("-", 100))
+	for _, row := range rows {
+		fmt.Fprintf(w, "%-8s | %-25s | %-10s | %-8s | %-20s | %s\n",
+			util.TruncateString(row.ID, 8),
+			util.TruncateString(row.Name, 25),
+			row.sizeText(),
+			row.progressText(),
+			row.statusText(),
+			util.TruncateString(row.Host, 25),
 		)
 	}
+	printListErrors(w, rows)
 }
 
-func loadSessionsFromDir(dir string) []*DownloadState {
-	var sessions []*DownloadState
+// printWideList prints every column in full, for pipes and wide
+// terminals.
+func printWideList(w io.Writer, rows []*sessionRow) {
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	fmt.Fprintln(tw, "ID\t| File Name\t| Size\t| Progress\t| Status\t| Updated\t| Host\t| Path")
+	for _, row := range rows {
+		fmt.Fprintf(tw, "%s\t| %s\t| %s\t| %s\t| %s\t| %s\t| %s\t| %s\n",
+			row.ID,
+			row.Name,
+			row.sizeText(),
+			row.progressText(),
+			row.statusText(),
+			formatTime(row.Updated),
+			orDash(row.Host),
+			orDash(row.Path),
+		)
+	}
+	tw.Flush()
+	printListErrors(w, rows)
+}
 
-	files, err := os.ReadDir(dir)
-	if err != nil {
-		return sessions
+func orDash(s string) string {
+	if s == "" {
+		return "-"
 	}
+	return s
+}
 
-	for _, file := range files {
-		if filepath.Ext(file.Name()) == ".json" {
-			baseName := file.Name()[:len(file.Name())-5]
-			path := filepath.Join(dir, baseName)
-			state, err := LoadState(path)
-			if err == nil {
-				sessions = append(sessions, state)
-			}
+func printListErrors(w io.Writer, rows []*sessionRow) {
+	first := true
+	for _, row := range rows {
+		if row.Error == "" {
+			continue
 		}
+		if first {
+			fmt.Fprintln(w)
+			first = false
+		}
+		fmt.Fprintf(w, "%s: %s\n", row.ID, row.Error)
 	}
+}
 
-	return sessions
+// groupName is what the group of state is shown as.
+func groupName(state *engine.DownloadState) string {
+	if state.GroupName != "" {
+		return state.GroupName
+	}
+	return state.Group
 }
 
-func updateSessionUrl(targetFile string, newUrl string) {
-	statePath := util.GetStatePath(targetFile)
+// sessionRow is one line of 'adam ls'. Sessions started from a url
+// pattern share a group and are folded into a single row. The fields
+// are exported for --format templates and --json.
+type sessionRow struct {
+	// ID is "-" for groups, their files are resumed one by one
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Path, URL and Host are only set when every file of the row
+	// shares them
+	Path  string `json:"path,omitempty"`
+	URL   string `json:"url,omitempty"`
+	Host  string `json:"host,omitempty"`
+	Group string `json:"group,omitempty"`
+	// Size and Progress are -1 when the size is not known
+	Size       int64     `json:"size"`
+	Downloaded int64     `json:"downloaded"`
+	Progress   float64   `json:"progress"`
+	Status     string    `json:"status"`
+	Files      int       `json:"files"`
+	FilesDone  int       `json:"files_done"`
+	Created    time.Time `json:"created"`
+	Updated    time.Time `json:"updated"`
+	Error      string    `json:"error,omitempty"`
+}
 
-	if _, err := os.Stat(statePath + ".json"); os.IsNotExist(err) {
-		fmt.Printf("Error: Could not find session for '%s'\n", targetFile)
-		fmt.Println("Tip: Use the exact filename from 'adam ls'")
-		return
+// sessionStatus works out what a single session is doing.
+func sessionStatus(state *engine.DownloadState, complete, active bool) string {
+	switch {
+	case complete:
+		return statusComplete
+	case active:
+		return statusActive
+	case state.LinkExpired:
+		return statusExpired
+	case state.LastError != "":
+		return statusFailed
 	}
+	return statusPaused
+}
+
+// statusRank orders statuses by how much they matter for a group: one
+// running file makes the group active, one expired link makes it
+// expired and so on.
+var statusRank = map[string]int{
+	statusComplete: 0,
+	statusPaused:   1,
+	statusFailed:   2,
+	statusExpired:  3,
+	statusActive:   4,
+}
+
+// partDone is how much of a part is on disk.
+func partDone(p *engine.Part) int64 {
+	if p.IsComplete {
+		return p.End - p.Start + 1
+	}
+	return p.CurrentOffset
+}
+
+// groupSessions folds sessions into rows. complete reports whether a
+// session finished, active whether it is being downloaded right now.
+func groupSessions(sessions []*engine.DownloadState, complete, active func(id string) bool) []*sessionRow {
+	var rows []*sessionRow
+	groups := make(map[string]*sessionRow)
 
-	state, err := LoadState(statePath)
+	for _, state := range sessions {
+		done := complete(state.ID)
+		var downloaded int64
+		if done && state.TotalSize > 0 {
+			downloaded = state.TotalSize
+		} else {
+			for _, p := range state.Parts {
+				downloaded += partDone(p)
+			}
+		}
+		if state.TotalSize > 0 && downloaded >= state.TotalSize {
+			done = true
+		}
+		status := sessionStatus(state, done, !done && active(state.ID))
+
+		row := groups[state.Group]
+		if row == nil || state.Group == "" {
+			row = &sessionRow{
+				ID:      state.ID,
+				Name:    filepath.Base(state.Filename),
+				Path:    state.Filename,
+				URL:     state.URL,
+				Host:    urlHost(state.URL),
+				Group:   state.Group,
+				Status:  status,
+				Created: state.Created,
+				Updated: state.Updated,
+			}
+			if state.Group != "" {
+				row.ID = "-"
+				row.Name = groupName(state)
+				row.Path = ""
+				row.URL = ""
+				groups[state.Group] = row
+			}
+			rows = append(rows, row)
+		}
+
+		if row.Size >= 0 {
+			if state.TotalSize > 0 {
+				row.Size += state.TotalSize
+			} else {
+				row.Size = -1
+			}
+		}
+		row.Downloaded += downloaded
+		row.Files++
+		if done {
+			row.FilesDone++
+		}
+		if statusRank[status] > statusRank[row.Status] {
+			row.Status = status
+		}
+		if row.Error == "" {
+			row.Error = state.LastError
+		}
+		if urlHost(state.URL) != row.Host {
+			row.Host = ""
+		}
+		if state.Created.Before(row.Created) {
+			row.Created = state.Created
+		}
+		if state.Updated.After(row.Updated) {
+			row.Updated = state.Updated
+		}
+	}
+
+	for _, row := range rows {
+		// a group is complete only when all of its files are
+		if row.Status == statusComplete && row.FilesDone < row.Files {
+			row.Status = statusPaused
+		}
+		switch {
+		case row.Size < 0:
+			row.Progress = -1
+		case row.Size > 0:
+			row.Progress = float64(row.Downloaded) / float64(row.Size) * 100
+		}
+	}
+	return rows
+}
+
+func updateSessionUrl(ref string, newUrl string) int {
+	store := engine.NewFileStore()
+
+	state, err := engine.FindSession(store, ref)
 	if err != nil {
-		fmt.Println("Error loading state:", err)
-		return
+		fmt.Println("Error:", err)
+		if errors.Is(err, engine.ErrSessionNotFound) {
+			fmt.Println("Tip: Use the ID or file name from 'adam ls'")
+		}
+		return exitUsage
 	}
 
 	fmt.Printf("Updating URL for %s...\n", state.Filename)
 	fmt.Printf("OLD: %s\n", util.TruncateString(state.URL, 50))
 	fmt.Printf("NEW: %s\n", util.TruncateString(newUrl, 50))
 
-	state.URL = newUrl
-	err = SaveState(statePath, state)
+	if err := setSessionUrl(store, state, newUrl); err != nil {
+		fmt.Println("Error:", err)
+		return exitFailure
+	}
+	fmt.Println("Success! Run 'adam resume " + state.ID + "' to continue.")
+	return exitOK
+}
+
+// setSessionUrl points a paused session at a new url and forgets why
+// the old one failed.
+func setSessionUrl(store *engine.FileStore, state *engine.DownloadState, newUrl string) error {
+	// a running download would overwrite the new url with its own save
+	unlock, err := store.Lock(state.ID)
 	if err != nil {
-		fmt.Println("Error saving state:", err)
-	} else {
-		fmt.Println("Success! Run 'adam resume " + targetFile + "' to continue.")
+		return err
+	}
+	defer unlock()
+
+	state.URL = newUrl
+	state.LinkExpired = false
+	state.LastError = ""
+	if err := store.Save(state); err != nil {
+		return fmt.Errorf("saving state: %w", err)
 	}
+	return nil
 }
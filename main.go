@@ -1,175 +1,278 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"time"
 
-	"adam/ui"
-	"adam/util"
+	"github.com/anuraggr/adam/engine"
+	"github.com/anuraggr/adam/ui"
 
 	tea "github.com/charmbracelet/bubbletea"
 )
 
+// Exit codes, so scripts can tell a bad command line from a failed
+// download.
+const (
+	exitOK          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitLinkExpired = 3
+	exitInterrupted = 130
+)
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: adam <url> [-o <name>] | adam resume <filename> | adam ls")
-		return
-	}
-	command := os.Args[1]
-	var url string
-	var customName string
-	var isResume bool
-
-	switch command {
-	case "ls", "list":
-		filter := "all"
-		if len(os.Args) > 2 {
-			switch os.Args[2] {
-			case "-c", "--complete":
-				filter = "complete"
-			case "--ongoing":
-				filter = "ongoing"
-			}
-		}
-		listSessions(filter)
-		return
+	os.Exit(run(os.Args[1:]))
+}
 
-	case "update":
-		if len(os.Args) < 4 {
-			fmt.Println("Usage: adam update <filename> <new_url>")
-			return
-		}
-		updateSessionUrl(os.Args[2], os.Args[3])
-		return
+// runGet starts a single new download.
+func runGet(url, output, dir string, headers []string, checksum string, df *downloadFlags) int {
+	name := output
+	if name == "" {
+		name = filepath.Base(url)
+	}
+	if dir != "" {
+		name = filepath.Join(dir, name)
+	}
 
-	case "resume":
-		if len(os.Args) < 3 {
-			fmt.Println("Usage: adam resume <filename>")
-			return
+	return runDownload(df, func(opts engine.Options) (*engine.Downloader, error) {
+		settings, err := df.settings()
+		if err != nil {
+			return nil, err
 		}
-		isResume = true
-
-	case "help":
-		printHelp()
-		return
-
-	default:
-		url = os.Args[1]
-		// Parse -o flag for custom output name
-		for i := 2; i < len(os.Args); i++ {
-			if os.Args[i] == "-o" && i+1 < len(os.Args) {
-				customName = os.Args[i+1]
-				break
+		if dir != "" {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return nil, err
 			}
 		}
-	}
+		opts.Settings = settings
+		opts.Headers = headers
+		opts.Checksum = checksum
+		return engine.New(context.Background(), url, name, opts)
+	})
+}
 
-	config := DefaultConfig()
-	var state *DownloadState
-	var totalSize int64
-	var outFileName string
-	var err error
+// runResume continues a saved session, ref is an ID or name. With wait
+// set it waits for another process to let go of the session.
+func runResume(ref string, wait bool, df *downloadFlags) int {
+	return runDownload(df, func(opts engine.Options) (*engine.Downloader, error) {
+		d, err := resumeSession(ref, opts, df)
+		if wait && errors.Is(err, engine.ErrSessionLocked) {
+			if !df.quiet {
+				fmt.Fprintf(os.Stderr, "%v, waiting...\n", err)
+			}
+			for errors.Is(err, engine.ErrSessionLocked) {
+				time.Sleep(time.Second)
+				d, err = resumeSession(ref, opts, df)
+			}
+		}
+		return d, err
+	})
+}
 
-	if isResume {
-		outFileName = os.Args[2]
-		statePath := util.GetStatePath(outFileName)
+func resumeSession(ref string, opts engine.Options, df *downloadFlags) (*engine.Downloader, error) {
+	state, err := engine.FindSession(engine.NewFileStore(), ref)
+	var broken *engine.SessionError
+	if errors.As(err, &broken) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, usageError{err}
+	}
 
-		state, err = LoadState(statePath)
-		if err != nil {
-			fmt.Printf("Error: No session found for '%s'\n", outFileName)
-			return
-		}
-		url = state.URL
-		totalSize = state.TotalSize
-		config.numWorkers = len(state.Parts)
-		fmt.Printf("Resuming download: %s\n", outFileName)
+	// a session keeps the settings it was started with unless a
+	// profile or flags say otherwise
+	if state.Settings != nil && df.profile == "" {
+		opts.Settings = *state.Settings
+		err = df.apply(&opts.Settings)
 	} else {
-		// fresh download
-		if customName != "" {
-			outFileName = customName
-		} else {
-			outFileName = filepath.Base(url)
-		}
-		statePath := util.GetStatePath(outFileName)
+		opts.Settings, err = df.settings()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := engine.Resume(state, opts)
+	if err != nil {
+		return nil, err
+	}
+	if !df.quiet {
+		fmt.Fprintf(infoWriter(df), "Resuming download: %s [%s]\n", state.Filename, state.ID)
+	}
+	return d, nil
+}
 
-		// remove any existing state and tmp files for this file
-		util.CleanupSession(outFileName, 20) // 20 as max possible workers to clean
+// infoWriter is where human readable notes go, json owns stdout so
+// they move to stderr there.
+func infoWriter(df *downloadFlags) io.Writer {
+	if df.progress == "json" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
 
-		totalSize, err = checkServerSupport(url)
-		if err == ErrNoRangeSupport {
-			fmt.Println("Server does not support range requests. Falling back to a single worker.")
-			config.numWorkers = 1
-			err = nil
-		}
-		if err != nil {
-			fmt.Println("Error:", err)
-			return
-		}
+// runDownload shows the progress of the downloader made by start, in
+// the TUI or headless, and returns the exit code.
+func runDownload(df *downloadFlags, start func(opts engine.Options) (*engine.Downloader, error)) int {
+	mode, rep, err := df.output()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitCode(err)
+	}
 
-		state = &DownloadState{
-			URL:       url,
-			Filename:  outFileName,
-			TotalSize: totalSize,
-			Parts:     make([]*Part, config.numWorkers),
+	opts := engine.DefaultOptions()
+	// events go to the reporter until the TUI takes over, program is
+	// set before Run starts so the workers never race with it
+	var program *tea.Program
+	opts.OnEvent = func(e engine.Event) {
+		if program == nil {
+			rep.Handle(e)
+		} else if msg := tuiMsg(e); msg != nil {
+			program.Send(msg)
 		}
+	}
 
-		chunkSize := totalSize / int64(config.numWorkers)
-		for i := 0; i < config.numWorkers; i++ {
-			start := int64(i) * chunkSize
-			end := start + chunkSize - 1
-			if i == config.numWorkers-1 {
-				end = totalSize - 1
-			}
+	d, err := start(opts)
+	if err != nil {
+		code := exitCode(err)
+		rep.Finish(err, code)
+		return code
+	}
+	defer d.Close()
 
-			state.Parts[i] = &Part{
-				ID:    i,
-				Start: start,
-				End:   end,
-			}
-		}
-		SaveState(statePath, state)
+	if mode != "tui" {
+		return runHeadless(d, rep)
 	}
 
-	model := ui.New(outFileName, totalSize)
-	program := tea.NewProgram(model, tea.WithAltScreen())
+	model := ui.New(filepath.Base(d.State().Filename), d.State().TotalSize, d)
+	program = tea.NewProgram(model, tea.WithAltScreen())
 
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
 	go func() {
-		RunDownload(config, state, model, program)
+		result <- d.Run(ctx)
 	}()
 
 	if _, err := program.Run(); err != nil {
-		fmt.Printf("Error running TUI: %v\n", err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "Error running TUI: %v\n", err)
+		cancel()
+		<-result
+		return exitFailure
+	}
+
+	// stop the workers if the user quit before the end
+	cancel()
+	downloadErr := <-result
+
+	quitMode := model.GetQuitMode()
+	handleQuitMode(quitMode, d)
+	if quitMode == ui.QuitModeNone && downloadErr != nil {
+		fmt.Fprintln(os.Stderr, "Error:", downloadErr)
+		fmt.Printf("Progress saved. Resume with: adam resume %s\n", d.State().ID)
+	}
+
+	switch {
+	case quitMode == ui.QuitModeClean:
+		return exitInterrupted
+	case quitMode == ui.QuitModeSave:
+		return exitOK
 	}
+	return exitCode(downloadErr)
+}
 
-	handleQuitMode(model.GetQuitMode(), state, config.numWorkers)
+// tuiMsg converts engine events into the messages ui.Model handles.
+func tuiMsg(e engine.Event) tea.Msg {
+	switch e := e.(type) {
+	case engine.SpeedEvent:
+		return ui.SpeedMsg{BytesPerSec: e.BytesPerSec, TimeRemaining: e.TimeRemaining, Received: e.Received}
+	case engine.DebugEvent:
+		return ui.DebugMsg{Message: e.Message}
+	case engine.WorkersEvent:
+		return ui.DebugMsg{Message: fmt.Sprintf("Workers: %d (%s)", e.Workers, e.Reason)}
+	case engine.ErrorEvent:
+		return ui.ErrorMsg{Error: e.Err}
+	case engine.DoneEvent:
+		return ui.DoneMsg{}
+	}
+	return nil
 }
 
-func handleQuitMode(mode ui.QuitMode, state *DownloadState, numWorkers int) {
+func handleQuitMode(mode ui.QuitMode, d *engine.Downloader) {
 	switch mode {
 	case ui.QuitModeClean:
-		util.CleanupSession(state.Filename, numWorkers)
+		d.Discard()
 		fmt.Println("Download cancelled.")
 
 	case ui.QuitModeSave:
-		SaveState(util.GetStatePath(state.Filename), state)
-		fmt.Printf("Download paused. Resume with: adam resume %s\n", state.Filename)
+		d.Save()
+		fmt.Printf("Download paused. Resume with: adam resume %s\n", d.State().ID)
 	}
 }
 
-func printHelp() {
-	fmt.Println(`Adam - A fast download manager with resume support
+func printHelp(w io.Writer) {
+	fmt.Fprintln(w, `Adam - A fast download manager with resume support
 
 Usage:
-  adam <url>                   Start a new download
-  adam <url> -o <name>         Download with custom filename
-  adam resume <filename>       Resume a paused download
-  adam update <file> <url>     Update the URL for a paused download
-  adam ls                      List all download sessions
-  adam ls --ongoing            List ongoing downloads only
-  adam ls -c                   List completed downloads only
-  adam help                    Show this help message
+  adam                           Open the session manager
+  adam [get] [options] <url>...  Download one or more urls
+  adam -i <file> [-j <n>]        Download every entry of an input file ('-' for stdin)
+  adam '<url_[01-20].bin>'       Download a numbered set, also {a,b,c} lists
+  adam resume [options] <id>     Resume a paused download by ID or file name
+  adam update <id> <url>         Update the URL for a paused download
+  adam ls [options] [pattern]    List download sessions, --sort, --host,
+                                 --json and --format '{{.ID}} {{.Status}}'
+  adam info <id>                 Show the details of a download
+  adam history [search]          List completed downloads, --format json|csv
+                                 exports them
+  adam rm [--keep-data] <id>...  Remove downloads and their part files,
+                                 --delete-file also a finished file
+  adam clean --complete [--older-than 30d]
+                                 Forget old completed downloads, --ongoing
+                                 removes abandoned ones with their data
+  adam gc [--dry-run] [dir...]   Delete leftover part files and broken sessions
+  adam help [command]            Show help for adam or a command
+
+Options for get:
+  -o, --output <name>            Save as name, #1, #2 ... insert pattern matches
+      --dir <dir>                Directory to save files in
+  -H, --header <'Name: value'>   Extra request header, may be repeated
+      --checksum <type=hex>      Verify the file after the download
+  -j, --parallel <n>             Download n files at a time
+  -g, --globoff                  Treat [] and {} in the url literally
+  -i, --input-file <file>        Read urls from a file
+
+Options for get and resume:
+  -n, --workers <n|auto>         Number of parallel connections, auto tunes it
+      --max-workers <n>          Most connections auto may open (default 16)
+      --max-conn-per-host <n>    Connections to the server, instead of the learned limit
+      --http1                    Use HTTP/1.1 so each worker gets its own connection
+      --http3                    Use HTTP/3 (QUIC) for https, falling back to TCP
+      --resolve <host:port:addr> Connect to addr for host:port, may be repeated
+  -4, --ipv4                     Connect over IPv4 only
+  -6, --ipv6                     Connect over IPv6 only
+      --dns-server <addr|url>    Look hosts up on this DNS server or DoH url
+      --interface <if,...>       Connect through these interfaces, e.g. eth0,eth1
+      --bind-address <addr,...>  Connect from these local addresses
+      --retries <n>              Attempts per part before giving up
+      --limit-rate <rate>        Cap the speed, e.g. 500KB or 2MB per second
+      --block-size <size>        Start parts on multiples of this, e.g. 1MB
+      --profile <name>           Use a [profiles.<name>] table from config.toml
+  -q, --quiet                    Print nothing but errors
+      --no-tui                   Print plain progress lines instead of the TUI.
+                                 This is the default when stdout is not a terminal.
+      --progress <tui|plain|json>
+                                 Choose the progress output. json writes one
+                                 event object per line for other programs.
+      --progress-fd <n>          Write json events to file descriptor n
+
+Options may come before or after the url.
+
+Exit codes:
+  0 success, 1 download failed, 2 usage error, 3 link expired, 130 interrupted
 
 Keyboard shortcuts (during download):
   p     Pause download
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anuraggr/adam/engine"
+	"github.com/anuraggr/adam/util"
+)
+
+const timeLayout = "2006-01-02 15:04:05"
+
+// findAnySession looks ref up among the ongoing sessions first and the
+// completed ones after that.
+func findAnySession(store *engine.FileStore, ref string) (*engine.DownloadState, bool, error) {
+	state, err := engine.FindSession(store, ref)
+	if err == nil || !errors.Is(err, engine.ErrSessionNotFound) {
+		return state, false, err
+	}
+	state, err = engine.FindCompleted(store, ref)
+	return state, err == nil, err
+}
+
+func downloadedBytes(state *engine.DownloadState) int64 {
+	var n int64
+	for _, p := range state.Parts {
+		n += p.CurrentOffset
+	}
+	return n
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(timeLayout)
+}
+
+func showSessionInfo(ref string) int {
+	store := engine.NewFileStore()
+	state, complete, err := findAnySession(store, ref)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitUsage
+	}
+	writeSessionInfo(os.Stdout, store, state, complete)
+	return exitOK
+}
+
+func writeSessionInfo(w io.Writer, store *engine.FileStore, state *engine.DownloadState, complete bool) {
+	downloaded := downloadedBytes(state)
+	status := "Ongoing"
+	switch {
+	case complete:
+		status = "Complete"
+	default:
+		if info, held := store.Holder(state.ID); held {
+			status = "Active (starting)"
+			if info.PID != 0 {
+				status = fmt.Sprintf("Active (pid %d on %s)", info.PID, info.Host)
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "ID:        %s\n", state.ID)
+	fmt.Fprintf(w, "File:      %s\n", state.Filename)
+	fmt.Fprintf(w, "URL:       %s\n", state.URL)
+	fmt.Fprintf(w, "Status:    %s\n", status)
+	if state.TotalSize > 0 {
+		fmt.Fprintf(w, "Progress:  %.1f%% (%s of %s)\n",
+			float64(downloaded)/float64(state.TotalSize)*100,
+			util.FormatBytes(downloaded),
+			util.FormatBytes(state.TotalSize))
+	} else {
+		fmt.Fprintf(w, "Progress:  %s (size unknown)\n", util.FormatBytes(downloaded))
+	}
+	if state.Group != "" {
+		fmt.Fprintf(w, "Group:     %s\n", groupName(state))
+	}
+	if state.Checksum != "" {
+		fmt.Fprintf(w, "Checksum:  %s\n", state.Checksum)
+	}
+	for _, h := range state.Headers {
+		fmt.Fprintf(w, "Header:    %s\n", h)
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Created:   %s\n", formatTime(state.Created))
+	fmt.Fprintf(w, "Updated:   %s\n", formatTime(state.Updated))
+	if complete {
+		fmt.Fprintf(w, "Completed: %s\n", formatTime(state.Completed))
+	}
+	if state.Elapsed > 0 {
+		fmt.Fprintf(w, "Time:      %s downloading, avg %s\n",
+			state.Elapsed.Round(time.Second),
+			util.FormatSpeed(float64(downloaded)/state.Elapsed.Seconds()))
+	}
+	if state.PeakSpeed > 0 {
+		fmt.Fprintf(w, "Peak:      %s\n", util.FormatSpeed(state.PeakSpeed))
+	}
+	if state.Digest != "" {
+		fmt.Fprintf(w, "Digest:    %s\n", state.Digest)
+	}
+
+	if srv := state.Server; srv != nil {
+		fmt.Fprintln(w)
+		if srv.FinalURL != "" && srv.FinalURL != state.URL {
+			fmt.Fprintf(w, "Final URL: %s\n", srv.FinalURL)
+		}
+		if srv.Server != "" {
+			fmt.Fprintf(w, "Server:    %s\n", srv.Server)
+		}
+		if srv.Protocol != "" {
+			fmt.Fprintf(w, "Protocol:  %s\n", srv.Protocol)
+		}
+		if srv.ContentType != "" {
+			fmt.Fprintf(w, "Type:      %s\n", srv.ContentType)
+		}
+		if srv.ETag != "" {
+			fmt.Fprintf(w, "ETag:      %s\n", srv.ETag)
+		}
+		if srv.LastModified != "" {
+			fmt.Fprintf(w, "Modified:  %s\n", srv.LastModified)
+		}
+	}
+
+	if s := state.Settings; s != nil {
+		limit := "none"
+		if s.RateLimit > 0 {
+			limit = util.FormatSpeed(float64(s.RateLimit))
+		}
+		fmt.Fprintf(w, "Settings:  %d workers, %d retries, rate limit %s\n", s.Workers, s.MaxRetries, limit)
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "%-4s | %-12s | %-12s | %-10s | %-8s | %-7s | %-8s | %-8s | %s\n", "Part", "Start", "End", "Done", "Progress", "Retries", "Restarts", "Status", "Protocol")
+	fmt.Fprintln(w, strings.Repeat("-", 101))
+	for _, p := range state.Parts {
+		size := p.End - p.Start + 1
+		percent := 0.0
+		if size > 0 {
+			percent = float64(p.CurrentOffset) / float64(size) * 100
+		}
+		partStatus := "pending"
+		switch {
+		case p.IsComplete:
+			partStatus = "complete"
+		case p.CurrentOffset > 0:
+			partStatus = "partial"
+		}
+		fmt.Fprintf(w, "%-4d | %-12d | %-12d | %-10s | %7.1f%% | %-7d | %-8d | %-8s | %s\n",
+			p.ID, p.Start, p.End, util.FormatBytes(p.CurrentOffset), percent, p.RetryCount, p.RestartCount, partStatus, p.Protocol)
+	}
+}
+
+// removeSession deletes a session: an ongoing one with its part files
+// unless keepData is set, a completed one only as a record unless
+// deleteFile is set.
+func removeSession(ref string, keepData, deleteFile bool) int {
+	store := engine.NewFileStore()
+	state, complete, err := findAnySession(store, ref)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitUsage
+	}
+
+	deleted, err := deleteSession(store, state, complete, !keepData, deleteFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailure
+	}
+	fmt.Printf("Removed session %s (%s)\n", state.ID, state.Filename)
+	switch {
+	case deleted == 0:
+	case complete:
+		fmt.Printf("Deleted %s\n", state.Filename)
+	default:
+		fmt.Printf("Deleted %d part files\n", deleted)
+	}
+	return exitOK
+}
+
+// deleteSession forgets a session. The part files of an ongoing one go
+// with it when deleteParts is set, the finished file of a completed one
+// when deleteFile is set and no later session downloaded to the same
+// path. It returns how many files were deleted.
+func deleteSession(store *engine.FileStore, state *engine.DownloadState, complete, deleteParts, deleteFile bool) (int, error) {
+	if complete && deleteFile {
+		if newer := newerSession(store, state); newer != nil {
+			return 0, fmt.Errorf("%s was downloaded again by session %s, not deleting it", state.Filename, newer.ID)
+		}
+	}
+	if !complete {
+		unlock, err := store.Lock(state.ID)
+		if err != nil {
+			return 0, err
+		}
+		defer unlock()
+	}
+
+	if err := store.Delete(state.ID); err != nil {
+		return 0, err
+	}
+	if complete {
+		if !deleteFile {
+			return 0, nil
+		}
+		if err := os.Remove(state.Filename); err != nil {
+			if os.IsNotExist(err) {
+				return 0, nil
+			}
+			return 0, err
+		}
+		return 1, nil
+	}
+	if !deleteParts {
+		return 0, nil
+	}
+	parts := util.PartFiles(state.Filename)
+	util.CleanupTempFiles(state.Filename)
+	return len(parts), nil
+}
+
+// newerSession finds a session, ongoing or completed, that was started
+// after state and writes to the same file.
+func newerSession(store *engine.FileStore, state *engine.DownloadState) *engine.DownloadState {
+	ongoing, _ := store.List(false)
+	completed, _ := store.List(true)
+	for _, other := range append(ongoing, completed...) {
+		if other.ID != state.ID && other.Filename == state.Filename && other.Created.After(state.Created) {
+			return other
+		}
+	}
+	return nil
+}
+
+// cleanSessions removes completed records and, with ongoing set,
+// abandoned downloads with their part files. Only sessions untouched
+// for olderThan are removed.
+func cleanSessions(complete, ongoing bool, olderThan time.Duration, dryRun bool) int {
+	store := engine.NewFileStore()
+	cutoff := time.Now().Add(-olderThan)
+	removed := 0
+
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+
+	if complete {
+		sessions, _ := store.List(true)
+		for _, state := range sessions {
+			finished := state.Completed
+			if finished.IsZero() {
+				finished = state.Updated
+			}
+			if finished.After(cutoff) {
+				continue
+			}
+			if !dryRun {
+				if err := store.Delete(state.ID); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %s: %v\n", state.ID, err)
+					continue
+				}
+			}
+			fmt.Printf("%s %s %s (completed %s)\n", verb, state.ID, filepath.Base(state.Filename), formatTime(finished))
+			removed++
+		}
+	}
+
+	if ongoing {
+		sessions, _ := store.List(false)
+		for _, state := range sessions {
+			if state.Updated.After(cutoff) {
+				continue
+			}
+			if _, held := store.Holder(state.ID); held {
+				continue
+			}
+			if !dryRun {
+				if err := store.Delete(state.ID); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %s: %v\n", state.ID, err)
+					continue
+				}
+				util.CleanupTempFiles(state.Filename)
+			}
+			fmt.Printf("%s %s %s (last active %s)\n", verb, state.ID, filepath.Base(state.Filename), formatTime(state.Updated))
+			removed++
+		}
+	}
+
+	if removed == 0 {
+		fmt.Println("Nothing to clean.")
+	}
+	return exitOK
+}
+
+// collectGarbage removes what no session accounts for: part files
+// left next to completed downloads, ongoing sessions whose part files
+// are gone, and temp and lock files left in the state directory by a
+// crash. Only part files of a path a readable session downloaded to are
+// touched, and with dirs only those in dirs. Sessions that can't be
+// read still own their part files; when their path can't be made out
+// either, no part file is removed.
+func collectGarbage(dirs []string, dryRun bool) int {
+	store := engine.NewFileStore()
+	ongoing, brokenOngoing := store.List(false)
+	completed, brokenCompleted := store.List(true)
+
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+	var freed int64
+	found := 0
+	remove := func(path, why string) {
+		st, err := os.Stat(path)
+		if err != nil {
+			return
+		}
+		if !dryRun {
+			if err := os.Remove(path); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				return
+			}
+		}
+		fmt.Printf("%s %s (%s, %s)\n", verb, path, why, util.FormatBytes(st.Size()))
+		freed += st.Size()
+		found++
+	}
+
+	// part files belong to ongoing sessions, readable or not
+	owned := make(map[string]bool)
+	for _, state := range ongoing {
+		path, _ := filepath.Abs(state.Filename)
+		owned[path] = true
+	}
+	unknownOwner := ""
+	for _, broken := range []struct {
+		dir      string
+		sessions []*engine.SessionError
+	}{{store.OngoingDir, brokenOngoing}, {store.CompleteDir, brokenCompleted}} {
+		for _, b := range broken.sessions {
+			filename, ok := sessionFilename(filepath.Join(broken.dir, b.ID+".json"))
+			if !ok {
+				unknownOwner = b.ID
+				continue
+			}
+			path, _ := filepath.Abs(filename)
+			owned[path] = true
+		}
+	}
+
+	var only map[string]bool
+	if len(dirs) > 0 {
+		only = make(map[string]bool)
+		for _, dir := range dirs {
+			path, _ := filepath.Abs(dir)
+			only[path] = true
+		}
+	}
+
+	if unknownOwner != "" {
+		fmt.Fprintf(os.Stderr, "Not removing part files: session %s can't be read and its part files can't be told apart\n", unknownOwner)
+	} else {
+		seen := make(map[string]bool)
+		for _, state := range completed {
+			path, _ := filepath.Abs(state.Filename)
+			if owned[path] || seen[path] || (only != nil && !only[filepath.Dir(path)]) {
+				continue
+			}
+			seen[path] = true
+			for _, part := range util.PartFiles(path) {
+				remove(part, "left by a finished download")
+			}
+		}
+
+		// in the dirs given, part files no ongoing session owns are left
+		// by 'rm --keep-data', 'clean' or a deleted session file
+		for dir := range only {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+			for _, e := range entries {
+				base, ok := util.PartFileBase(e.Name())
+				if !ok || e.IsDir() || owned[filepath.Join(dir, base)] {
+					continue
+				}
+				// a new download may not have saved its session yet
+				if info, err := e.Info(); err == nil && time.Since(info.ModTime()) > time.Minute {
+					remove(filepath.Join(dir, e.Name()), "no download owns it")
+				}
+			}
+		}
+	}
+
+	// a session with progress but no part files can't be resumed
+	for _, state := range ongoing {
+		if downloadedBytes(state) == 0 || len(util.PartFiles(state.Filename)) > 0 {
+			continue
+		}
+		if _, held := store.Holder(state.ID); held {
+			continue
+		}
+		remove(filepath.Join(store.OngoingDir, state.ID+".json"), "part files of "+filepath.Base(state.Filename)+" are missing")
+	}
+
+	for _, dir := range []string{store.OngoingDir, store.CompleteDir} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			name := e.Name()
+			switch {
+			case strings.HasSuffix(name, ".tmp"):
+				// a save that never got renamed into place, recent ones
+				// may belong to a running download
+				if info, err := e.Info(); err == nil && time.Since(info.ModTime()) > time.Minute {
+					remove(filepath.Join(dir, name), "unfinished state write")
+				}
+			case strings.HasSuffix(name, ".lock"):
+				id := strings.TrimSuffix(name, ".lock")
+				if _, held := store.Holder(id); held {
+					continue
+				}
+				if dryRun {
+					remove(filepath.Join(dir, name), "stale lock")
+					continue
+				}
+				// a resume may take the lock over at the same time
+				st, err := e.Info()
+				if err != nil {
+					continue
+				}
+				if cleared, err := store.ClearStaleLock(id); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				} else if cleared {
+					fmt.Printf("%s %s (stale lock, %s)\n", verb, filepath.Join(dir, name), util.FormatBytes(st.Size()))
+					freed += st.Size()
+					found++
+				}
+			}
+		}
+	}
+
+	if found == 0 {
+		fmt.Println("Nothing to collect.")
+		return exitOK
+	}
+	fmt.Printf("%d files, %s\n", found, util.FormatBytes(freed))
+	return exitOK
+}
+
+// sessionFilename reads the output path from a session file that does
+// not load as a session, e.g. one saved by a newer adam.
+func sessionFilename(path string) (string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	var v struct {
+		Filename string `json:"filename"`
+	}
+	if json.Unmarshal(data, &v) != nil || v.Filename == "" {
+		return "", false
+	}
+	return v.Filename, true
+}
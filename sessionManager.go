@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anuraggr/adam/engine"
+	"github.com/anuraggr/adam/ui"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/spf13/pflag"
+)
+
+// managerBackend gives the TUI manager access to the session store.
+type managerBackend struct {
+	store *engine.FileStore
+}
+
+func (b *managerBackend) Sessions() ([]ui.SessionItem, error) {
+	var items []ui.SessionItem
+	add := func(sessions []*engine.DownloadState, complete bool) {
+		for _, state := range sessions {
+			var downloaded int64
+			for _, p := range state.Parts {
+				downloaded += partDone(p)
+			}
+			done := complete || (state.TotalSize > 0 && downloaded >= state.TotalSize)
+			active := false
+			if !done {
+				_, active = b.store.Holder(state.ID)
+			}
+			items = append(items, ui.SessionItem{
+				ID:         state.ID,
+				Name:       filepath.Base(state.Filename),
+				URL:        state.URL,
+				Size:       max(state.TotalSize, 0),
+				Downloaded: downloaded,
+				Status:     sessionStatus(state, done, active),
+			})
+		}
+	}
+
+	ongoing, _ := b.store.List(false)
+	complete, _ := b.store.List(true)
+	add(ongoing, false)
+	add(complete, true)
+	return items, nil
+}
+
+func (b *managerBackend) find(id string) (*engine.DownloadState, bool, error) {
+	return findAnySession(b.store, id)
+}
+
+func (b *managerBackend) Details(id string) (string, error) {
+	state, complete, err := b.find(id)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	writeSessionInfo(&sb, b.store, state, complete)
+	return sb.String(), nil
+}
+
+func (b *managerBackend) Delete(id string) error {
+	state, complete, err := b.find(id)
+	if err != nil {
+		return err
+	}
+	// a finished file stays, only the record goes
+	_, err = deleteSession(b.store, state, complete, true, false)
+	return err
+}
+
+func (b *managerBackend) UpdateURL(id, url string) error {
+	state, err := engine.FindSession(b.store, id)
+	if err != nil {
+		return err
+	}
+	return setSessionUrl(b.store, state, url)
+}
+
+// runManager shows the session manager until the user quits. Resuming
+// or starting a download leaves it for the download view and comes
+// back when that ends.
+func runManager() int {
+	backend := &managerBackend{store: engine.NewFileStore()}
+	// downloads started here get the same defaults as 'adam <url>'
+	df := addDownloadFlags(pflag.NewFlagSet("manager", pflag.ContinueOnError))
+
+	message := ""
+	for {
+		m := ui.NewManager(backend, message)
+		if _, err := tea.NewProgram(m, tea.WithAltScreen()).Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error running TUI: %v\n", err)
+			return exitFailure
+		}
+
+		var code int
+		action, arg := m.Result()
+		switch action {
+		case ui.ActionResume:
+			code = runResume(arg, false, df)
+		case ui.ActionNew:
+			code = runGet(arg, "", "", nil, "", df)
+		default:
+			return exitOK
+		}
+
+		message = ""
+		switch code {
+		case exitOK:
+		case exitInterrupted:
+			message = "Download cancelled."
+		default:
+			// the error is printed on the normal screen, give the user
+			// a chance to read it before the manager covers it
+			fmt.Print("Press enter to go back to the list")
+			bufio.NewReader(os.Stdin).ReadString('\n')
+			if code == exitLinkExpired {
+				message = "The link has expired, press u to give the download a new url."
+			}
+		}
+	}
+}
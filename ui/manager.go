@@ -0,0 +1,414 @@
+package ui
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/anuraggr/adam/util"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// SessionItem is one download in the manager list.
+type SessionItem struct {
+	ID         string
+	Name       string
+	URL        string
+	Size       int64 // 0 when unknown
+	Downloaded int64
+	// Status is paused, active, failed, expired or complete
+	Status string
+}
+
+func (s SessionItem) complete() bool { return s.Status == "complete" }
+func (s SessionItem) active() bool   { return s.Status == "active" }
+
+// ManagerBackend does the work behind the manager's keys.
+type ManagerBackend interface {
+	Sessions() ([]SessionItem, error)
+	Details(id string) (string, error)
+	Delete(id string) error
+	UpdateURL(id, url string) error
+}
+
+// ManagerAction is what the user left the manager to do.
+type ManagerAction int
+
+const (
+	ActionQuit ManagerAction = iota
+	ActionResume
+	ActionNew
+)
+
+type managerMode int
+
+const (
+	modeList managerMode = iota
+	modeDetails
+	modeConfirmDelete
+	modeUpdateURL
+	modeNewURL
+)
+
+type refreshMsg struct{}
+
+func refreshCmd() tea.Cmd {
+	return tea.Tick(time.Second, func(t time.Time) tea.Msg {
+		return refreshMsg{}
+	})
+}
+
+// Manager lists the saved sessions and lets the user resume, delete,
+// inspect and re-link them or start a new download. Downloads are not
+// run here: the manager quits and Result says what to run.
+type Manager struct {
+	backend ManagerBackend
+	items   []SessionItem
+	cursor  int
+	width   int
+	height  int
+
+	mode    managerMode
+	details string
+	input   []rune
+	message string
+
+	action ManagerAction
+	arg    string
+}
+
+// NewManager makes a manager over backend. message is shown in the
+// status line, e.g. how the last download ended.
+func NewManager(backend ManagerBackend, message string) *Manager {
+	m := &Manager{backend: backend, message: message}
+	m.reload()
+	return m
+}
+
+// Result is what the user picked: a session id to resume or a url to
+// download, with ActionQuit when they just left.
+func (m *Manager) Result() (ManagerAction, string) {
+	return m.action, m.arg
+}
+
+func (m *Manager) reload() {
+	items, err := m.backend.Sessions()
+	if err != nil {
+		m.message = "Error: " + err.Error()
+		return
+	}
+
+	// stay on the same session when the list changes under us
+	var selected string
+	if m.cursor < len(m.items) {
+		selected = m.items[m.cursor].ID
+	}
+	m.items = items
+	for i, item := range items {
+		if item.ID == selected {
+			m.cursor = i
+		}
+	}
+	if m.cursor >= len(m.items) {
+		m.cursor = len(m.items) - 1
+	}
+	if m.cursor < 0 {
+		m.cursor = 0
+	}
+}
+
+func (m *Manager) selected() (SessionItem, bool) {
+	if m.cursor < len(m.items) {
+		return m.items[m.cursor], true
+	}
+	return SessionItem{}, false
+}
+
+func (m *Manager) Init() tea.Cmd {
+	return tea.Batch(
+		tea.EnterAltScreen,
+		refreshCmd(),
+	)
+}
+
+func (m *Manager) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width = msg.Width
+		m.height = msg.Height
+		return m, nil
+
+	case refreshMsg:
+		if m.mode == modeList {
+			m.reload()
+		}
+		return m, refreshCmd()
+
+	case tea.KeyMsg:
+		if msg.String() == "ctrl+c" {
+			m.action = ActionQuit
+			return m, tea.Quit
+		}
+		switch m.mode {
+		case modeDetails:
+			m.mode = modeList
+			return m, nil
+		case modeConfirmDelete:
+			return m.updateConfirm(msg)
+		case modeUpdateURL, modeNewURL:
+			return m.updatePrompt(msg)
+		}
+		return m.updateList(msg)
+	}
+	return m, nil
+}
+
+func (m *Manager) updateList(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	item, ok := m.selected()
+
+	switch msg.String() {
+	case "q", "esc":
+		m.action = ActionQuit
+		return m, tea.Quit
+	case "up", "k":
+		if m.cursor > 0 {
+			m.cursor--
+		}
+	case "down", "j":
+		if m.cursor < len(m.items)-1 {
+			m.cursor++
+		}
+	case "home", "g":
+		m.cursor = 0
+	case "end", "G":
+		m.cursor = max(len(m.items)-1, 0)
+	case "n":
+		m.mode = modeNewURL
+		m.input = nil
+	case "enter", "r":
+		switch {
+		case !ok:
+		case item.complete():
+			m.message = item.Name + " is already complete"
+		case item.active():
+			m.message = item.Name + " is being downloaded by another adam"
+		default:
+			m.action = ActionResume
+			m.arg = item.ID
+			return m, tea.Quit
+		}
+	case "i":
+		if !ok {
+			break
+		}
+		details, err := m.backend.Details(item.ID)
+		if err != nil {
+			m.message = "Error: " + err.Error()
+			break
+		}
+		m.details = details
+		m.mode = modeDetails
+	case "d", "delete":
+		switch {
+		case !ok:
+		case item.active():
+			m.message = item.Name + " is being downloaded by another adam"
+		default:
+			m.mode = modeConfirmDelete
+		}
+	case "u":
+		switch {
+		case !ok:
+		case item.complete():
+			m.message = item.Name + " is already complete"
+		case item.active():
+			m.message = item.Name + " is being downloaded by another adam"
+		default:
+			m.mode = modeUpdateURL
+			m.input = []rune(item.URL)
+		}
+	}
+	return m, nil
+}
+
+func (m *Manager) updateConfirm(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.mode = modeList
+	if msg.String() != "y" {
+		return m, nil
+	}
+	item, ok := m.selected()
+	if !ok {
+		return m, nil
+	}
+	if err := m.backend.Delete(item.ID); err != nil {
+		m.message = "Error: " + err.Error()
+	} else {
+		m.message = "Removed " + item.Name
+	}
+	m.reload()
+	return m, nil
+}
+
+func (m *Manager) updatePrompt(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyEsc:
+		m.mode = modeList
+	case tea.KeyBackspace:
+		if len(m.input) > 0 {
+			m.input = m.input[:len(m.input)-1]
+		}
+	case tea.KeyCtrlU:
+		m.input = nil
+	case tea.KeyRunes, tea.KeySpace:
+		m.input = append(m.input, msg.Runes...)
+	case tea.KeyEnter:
+		url := strings.TrimSpace(string(m.input))
+		mode := m.mode
+		m.mode = modeList
+		if url == "" {
+			return m, nil
+		}
+		if mode == modeNewURL {
+			m.action = ActionNew
+			m.arg = url
+			return m, tea.Quit
+		}
+		item, ok := m.selected()
+		if !ok {
+			return m, nil
+		}
+		if err := m.backend.UpdateURL(item.ID, url); err != nil {
+			m.message = "Error: " + err.Error()
+		} else {
+			m.message = "Updated the url of " + item.Name
+		}
+		m.reload()
+	}
+	return m, nil
+}
+
+func (m *Manager) View() string {
+	var b strings.Builder
+
+	b.WriteString(TitleStyle.Render(" 📥 adam "))
+	b.WriteString("\n\n")
+
+	if m.mode == modeDetails {
+		lines := strings.Split(strings.TrimRight(m.details, "\n"), "\n")
+		// long part tables would push the title off the screen
+		if m.height > 0 && len(lines) > m.height-7 {
+			lines = append(lines[:max(m.height-8, 1)], "...")
+		}
+		b.WriteString(BorderStyle.Render(strings.Join(lines, "\n")))
+		b.WriteString("\n\nPress any key to go back\n")
+		return b.String()
+	}
+
+	if len(m.items) == 0 {
+		b.WriteString("No sessions found.\n")
+	} else {
+		b.WriteString(m.listView())
+	}
+
+	b.WriteString("\n")
+	switch m.mode {
+	case modeConfirmDelete:
+		item, _ := m.selected()
+		prompt := fmt.Sprintf("Delete %s and its part files? (y/n)", item.Name)
+		if item.complete() {
+			prompt = fmt.Sprintf("Forget %s? The file stays. (y/n)", item.Name)
+		}
+		b.WriteString(PausedStyle.Render(prompt))
+		b.WriteString("\n")
+	case modeUpdateURL:
+		b.WriteString("New url: " + string(m.input) + "█\n")
+		b.WriteString(StatsStyle.Render("enter save │ ctrl+u clear │ esc cancel"))
+		b.WriteString("\n")
+	case modeNewURL:
+		b.WriteString("Download url: " + string(m.input) + "█\n")
+		b.WriteString(StatsStyle.Render("enter start │ ctrl+u clear │ esc cancel"))
+		b.WriteString("\n")
+	default:
+		if m.message != "" {
+			b.WriteString(m.message + "\n")
+		}
+		b.WriteString(StatsStyle.Render("enter resume │ n new │ i details │ u update url │ d delete │ q quit"))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func (m *Manager) listView() string {
+	const barWidth = 12
+	nameWidth := 30
+	if m.width > 0 {
+		// id, size, bar, percent and status take about 60 columns
+		nameWidth = min(max(m.width-62, 12), 50)
+	}
+
+	// scroll so the cursor stays visible
+	visible := len(m.items)
+	if m.height > 0 {
+		visible = max(m.height-9, 1)
+	}
+	first := 0
+	if m.cursor >= visible {
+		first = m.cursor - visible + 1
+	}
+	last := min(first+visible, len(m.items))
+
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("  %-8s  %-*s  %-10s  %-*s  %-6s  %s\n",
+		"ID", nameWidth, "File Name", "Size", barWidth, "Progress", "", "Status"))
+	for i := first; i < last; i++ {
+		item := m.items[i]
+
+		percent := 0.0
+		if item.complete() {
+			percent = 100
+		} else if item.Size > 0 {
+			percent = float64(item.Downloaded) / float64(item.Size) * 100
+		}
+		filled := int(percent / 100 * barWidth)
+		bar := CompleteStyle.Render(strings.Repeat(CompleteChar, filled)) +
+			IncompleteStyle.Render(strings.Repeat(IncompleteChar, barWidth-filled))
+
+		size := "?"
+		if item.Size > 0 {
+			size = util.FormatBytes(item.Size)
+		}
+
+		marker := "  "
+		if i == m.cursor {
+			marker = SpeedStyle.Render("> ")
+		}
+		b.WriteString(fmt.Sprintf("%s%-8s  %-*s  %-10s  %s  %5.1f%%  %s\n",
+			marker,
+			util.TruncateString(item.ID, 8),
+			nameWidth, util.TruncateString(item.Name, nameWidth),
+			size,
+			bar,
+			percent,
+			statusStyle(item.Status).Render(item.Status),
+		))
+	}
+	if last < len(m.items) || first > 0 {
+		b.WriteString(StatsStyle.Render(fmt.Sprintf("%d-%d of %d", first+1, last, len(m.items))))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func statusStyle(status string) lipgloss.Style {
+	switch status {
+	case "complete":
+		return DoneStyle
+	case "active":
+		return SpeedStyle
+	case "failed", "expired":
+		return ErrorStyle
+	}
+	return PausedStyle
+}
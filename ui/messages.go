@@ -9,6 +9,7 @@ import (
 type SpeedMsg struct {
 	BytesPerSec   float64
 	TimeRemaining time.Duration
+	Received      int64
 }
 
 type DoneMsg struct{}
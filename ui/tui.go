@@ -6,7 +6,8 @@ import (
 	"sync"
 	"time"
 
-	"adam/util"
+	"github.com/anuraggr/adam/engine"
+	"github.com/anuraggr/adam/util"
 
 	tea "github.com/charmbracelet/bubbletea"
 )
@@ -15,104 +16,47 @@ const defaultRows = 8 // rows are fixed for now
 
 // Bubble tea model
 type Model struct {
-	mu             sync.RWMutex
-	width          int
-	height         int
-	rows           int
-	cols           int
-	chunks         int // rows * cols
-	chunkStatus    []bool
-	bytesTotal     int64
-	speed          float64
-	done           bool
-	err            error
-	fileName       string
-	startTime      time.Time
-	timeRemaining  time.Duration
-	progressMu     sync.RWMutex
-	workerProgress map[int]*WorkerProgress // worker id -> progress
-
-	// Pause state
-	paused   bool
-	pauseCh  chan struct{}
-	pauseMu  sync.RWMutex
-	quitMode QuitMode
+	mu            sync.RWMutex
+	width         int
+	height        int
+	rows          int
+	cols          int
+	chunks        int // rows * cols
+	chunkStatus   []bool
+	bytesTotal    int64
+	speed         float64
+	done          bool
+	err           error
+	fileName      string
+	startTime     time.Time
+	timeRemaining time.Duration
+	source        Source
+	progress      engine.Progress // refreshed from source every tick
+	quitMode      QuitMode
 
 	// Debug
 	debugMessages []string
 }
 
-type WorkerProgress struct {
-	Start    int64
-	End      int64
-	Received int64
+// Source is the running download shown by the model, usually an
+// *engine.Downloader.
+type Source interface {
+	Pause()
+	Resume()
+	IsPaused() bool
+	Progress() engine.Progress
 }
 
-func New(fileName string, totalSize int64) *Model {
+func New(fileName string, totalSize int64, source Source) *Model {
 	return &Model{
-		fileName:       fileName,
-		bytesTotal:     totalSize,
-		rows:           defaultRows,
-		startTime:      time.Now(),
-		workerProgress: make(map[int]*WorkerProgress),
-		pauseCh:        make(chan struct{}),
+		fileName:   fileName,
+		bytesTotal: totalSize,
+		rows:       defaultRows,
+		startTime:  time.Now(),
+		source:     source,
 	}
 }
 
-// register workers byte range
-func (m *Model) RegisterWorker(id int, start, end int64) {
-	m.progressMu.Lock()
-	defer m.progressMu.Unlock()
-	m.workerProgress[id] = &WorkerProgress{
-		Start: start,
-		End:   end,
-	}
-}
-
-// update workers downloaded bytes
-func (m *Model) UpdateWorkerProgress(id int, received int64) {
-	m.progressMu.Lock()
-	defer m.progressMu.Unlock()
-	if wp, ok := m.workerProgress[id]; ok {
-		wp.Received = received
-	}
-}
-
-func (m *Model) Pause() {
-	m.pauseMu.Lock()
-	defer m.pauseMu.Unlock()
-	if !m.paused {
-		m.paused = true
-		m.pauseCh = make(chan struct{})
-	}
-}
-
-func (m *Model) Resume() {
-	m.pauseMu.Lock()
-	defer m.pauseMu.Unlock()
-	if m.paused {
-		m.paused = false
-		close(m.pauseCh)
-	}
-}
-
-func (m *Model) IsPaused() bool {
-	m.pauseMu.RLock()
-	defer m.pauseMu.RUnlock()
-	return m.paused
-}
-
-func (m *Model) WaitIfPaused() {
-	m.pauseMu.RLock()
-	if m.paused {
-		ch := m.pauseCh
-		m.pauseMu.RUnlock()
-		<-ch // block until resumed
-		return
-	}
-	m.pauseMu.RUnlock()
-}
-
 func (m *Model) SetQuitMode(mode QuitMode) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -151,25 +95,21 @@ func (m *Model) recalculateGrid() {
 }
 
 func (m *Model) updateChunksFromWorkers() {
-	if m.bytesTotal == 0 || m.chunks == 0 {
-		return
-	}
-
-	m.progressMu.RLock()
-	defer m.progressMu.RUnlock()
+	progress := m.source.Progress()
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	m.progress = progress
+	if m.bytesTotal == 0 || m.chunks == 0 {
+		return
+	}
+
 	for i := range m.chunkStatus {
 		m.chunkStatus[i] = false
 	}
 
-	for _, wp := range m.workerProgress {
-		if wp == nil {
-			continue
-		}
-
+	for _, wp := range progress.Parts {
 		workerStartChunk := int((wp.Start * int64(m.chunks)) / m.bytesTotal)
 		workerEndChunk := int((wp.End * int64(m.chunks)) / m.bytesTotal)
 
@@ -190,16 +130,9 @@ func (m *Model) updateChunksFromWorkers() {
 }
 
 func (m *Model) TotalReceived() int64 {
-	m.progressMu.RLock()
-	defer m.progressMu.RUnlock()
-
-	var total int64
-	for _, wp := range m.workerProgress {
-		if wp != nil {
-			total += wp.Received
-		}
-	}
-	return total
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.progress.Received
 }
 
 func (m *Model) CompletedChunks() int {
@@ -220,16 +153,22 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case tea.KeyMsg:
 		switch msg.String() {
 		case "q", "ctrl+c", "esc":
-			m.SetQuitMode(QuitModeClean)
+			m.mu.RLock()
+			failed := m.err != nil
+			m.mu.RUnlock()
+			// a failed download is kept so its url can be fixed
+			if !failed {
+				m.SetQuitMode(QuitModeClean)
+			}
 			return m, tea.Quit
 		case "s":
 			m.SetQuitMode(QuitModeSave)
 			return m, tea.Quit
 		case "p":
-			m.Pause()
+			m.source.Pause()
 			return m, nil
 		case "r":
-			m.Resume()
+			m.source.Resume()
 			return m, nil
 		}
 
@@ -294,6 +233,7 @@ func (m *Model) View() string {
 	fileName := m.fileName
 	bytesTotal := m.bytesTotal
 	startTime := m.startTime
+	progress := m.progress
 	m.mu.RUnlock()
 
 	if width == 0 || chunks == 0 {
@@ -345,6 +285,14 @@ func (m *Model) View() string {
 	))
 	b.WriteString(stats)
 	b.WriteString("\n")
+	if progress.Protocol != "" {
+		b.WriteString(StatsStyle.Render(fmt.Sprintf("%s │ Connections: %d", progress.Protocol, progress.Connections)))
+		b.WriteString("\n")
+	}
+	for _, l := range progress.Links {
+		b.WriteString(StatsStyle.Render(fmt.Sprintf("%s: %s │ %s │ Connections: %d", l.Name, util.FormatSpeed(l.BytesPerSec), util.FormatBytes(l.Received), l.Connections)))
+		b.WriteString("\n")
+	}
 
 	if err != nil {
 		b.WriteString(fmt.Sprintf("\n❌ Error: %v\n", err))
@@ -353,7 +301,7 @@ func (m *Model) View() string {
 		b.WriteString("\n")
 		b.WriteString(DoneStyle.Render("✅ Download complete!"))
 		b.WriteString("\n")
-	} else if m.IsPaused() {
+	} else if m.source.IsPaused() {
 		b.WriteString("\n")
 		b.WriteString(PausedStyle.Render("⏸ PAUSED"))
 		b.WriteString("\n")
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func FormatBytes(bytes int64) string {
@@ -39,6 +42,36 @@ func FormatSpeed(bps float64) string {
 	return fmt.Sprintf("%.1f %s", bps, units[unitIndex])
 }
 
+// ParseBytes reads sizes like "512", "100K", "1.5MB" or "2GiB". Units
+// are powers of 1024, the same as FormatBytes prints them.
+func ParseBytes(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "IB"), "B")
+
+	multiplier := float64(1)
+	if n := len(str); n > 0 {
+		switch str[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			str = str[:n-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(value * multiplier), nil
+}
+
 func GetConfigDir() string {
 	configDir, err := os.UserConfigDir()
 	if err != nil {
@@ -64,31 +97,79 @@ func GetCompleteDir() string {
 	return dir
 }
 
-func GetStatePath(filename string) string {
-	return filepath.Join(GetOngoingDir(), filename)
-}
-
-func CleanupTempFiles(baseFilename string, numWorkers int) {
-	for i := 0; i < numWorkers; i++ {
-		os.Remove(fmt.Sprintf("%s.part_%d.tmp", baseFilename, i))
+// CleanupTempFiles removes every part file of baseFilename, however
+// many workers wrote them.
+func CleanupTempFiles(baseFilename string) {
+	for _, path := range PartFiles(baseFilename) {
+		os.Remove(path)
 	}
 }
 
-func MoveToComplete(filename string) error {
-	src := filepath.Join(GetOngoingDir(), filename+".json")
-	dst := filepath.Join(GetCompleteDir(), filename+".json")
+// PartFiles lists the "<base>.part_N.tmp" files that exist for
+// baseFilename.
+func PartFiles(baseFilename string) []string {
+	dir := filepath.Dir(baseFilename)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
 
-	return os.Rename(src, dst)
+	var paths []string
+	for _, e := range entries {
+		if base, ok := PartFileBase(e.Name()); ok && base == filepath.Base(baseFilename) {
+			paths = append(paths, filepath.Join(dir, e.Name()))
+		}
+	}
+	return paths
 }
 
-func CleanupSession(filename string, numWorkers int) {
-	os.Remove(GetStatePath(filename) + ".json")
-	CleanupTempFiles(filename, numWorkers)
+// PartFileBase returns the output name a part file belongs to, ok is
+// false for names that are not part files.
+func PartFileBase(name string) (string, bool) {
+	rest, ok := strings.CutSuffix(name, ".tmp")
+	if !ok {
+		return "", false
+	}
+	i := strings.LastIndex(rest, ".part_")
+	if i <= 0 {
+		return "", false
+	}
+	digits := rest[i+len(".part_"):]
+	if digits == "" {
+		return "", false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return "", false
+		}
+	}
+	return rest[:i], true
 }
 
-func CompleteSession(filename string, numWorkers int) {
-	MoveToComplete(filename)
-	CleanupTempFiles(filename, numWorkers)
+// ParseAge reads durations like "90m", "36h", "30d" or "2w". Days and
+// weeks are added to what time.ParseDuration accepts.
+func ParseAge(s string) (time.Duration, error) {
+	str := strings.TrimSpace(s)
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(str, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(str, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+	if unit == 0 {
+		d, err := time.ParseDuration(str)
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return d, nil
+	}
+
+	n, err := strconv.ParseFloat(str[:len(str)-1], 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return time.Duration(n * float64(unit)), nil
 }
 
 func TruncateString(str string, maxLen int) string {